@@ -1,7 +1,14 @@
 package ack
 
 import (
+	"cmp"
+	"context"
 	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -9,9 +16,35 @@ import (
 var (
 	ErrMsgRecordFailed = errors.New("the buffer is full, asynchronously record msg failed")
 	ErrMsgAckFailed    = errors.New("the buffer is full, asynchronously ack msg failed")
+	ErrRunning         = errors.New("the daemon goroutine is running")
+	ErrRateLimited     = errors.New("the rate limit is exceeded, record msg failed")
+	ErrValueTooLarge   = errors.New("the value is too large, record msg failed")
+	ErrMemoryLimit     = errors.New("the memory limit is exceeded, record msg failed")
+	ErrAsync           = errors.New("the operation is not supported in async mode")
+	ErrEncoding        = errors.New("the flag or value can't be encoded or decoded")
+	ErrDraining        = errors.New("the buffers are being drained, record msg failed")
+	ErrPendingLimit    = errors.New("the pending limit is reached, record msg failed")
 )
 
-type Config[flag any] struct {
+// AckError is the error of Set or Ack failed because the async buffer is full. It wraps
+// ErrMsgRecordFailed or ErrMsgAckFailed, so errors.Is still matches them, and tells how full the
+// buffer was.
+type AckError struct {
+	Err error
+	// Len and Cap are the length and the capacity of the buffer when it's found full. Len may be
+	// less than Cap as the buffer is drained concurrently.
+	Len, Cap int
+}
+
+func (e *AckError) Error() string {
+	return fmt.Sprintf("%v (buffer %d/%d full)", e.Err, e.Len, e.Cap)
+}
+
+func (e *AckError) Unwrap() error {
+	return e.Err
+}
+
+type Config[flag, val any] struct {
 	// segment lock is used to increase concurrency. Record messages are hashed to different
 	// segments by message id. Capacity is the number of segments ack manager used. It must
 	// be bigger than 0.
@@ -24,6 +57,31 @@ type Config[flag any] struct {
 	// Async mode.
 	SetBufferSize int64
 	AckBufferSize int64
+	// OverflowPolicy decides what Set and Ack do when the buffer is full in async mode. They wait
+	// for room by default. Note that they used to fail immediately, set OverflowError to keep
+	// that behavior. TrySet and TryAck always fail immediately.
+	OverflowPolicy OverflowPolicy
+	// OnOverflow is called with every message dropped because the buffer is full in async mode,
+	// before Set or Ack fails, so that callers can persist or log it. Dropped acks carry only
+	// their ID and Flag.
+	OnOverflow func(m *Msg[flag, val])
+	// DrainPolicy decides what Set does in async mode while the buffers are drained by
+	// StopAndDrain, DrainSetCh or DrainAckCh. It fails with ErrDraining by default.
+	DrainPolicy DrainPolicy
+	// PerSegmentChannels gives every segment its own buffers and daemon goroutine, instead of
+	// funneling all async messages through a single pair of buffers and daemon goroutine. The
+	// buffer sizes apply to each segment.
+	PerSegmentChannels bool
+	// OrderedSetAck buffers acks together with sets in the set buffer, so that they are processed
+	// in the order they are called. Otherwise an ack can be processed before the set of the same
+	// message called earlier, which leaves the message pending. AckBufferSize is not used then.
+	OrderedSetAck bool
+	// Workers is the number of buffers and daemon goroutines in async mode, decoupling them from
+	// the number of segments. Segment i is served by worker i % Workers, so a worker serves
+	// Capacity / Workers segments, one more for the first Capacity % Workers workers. It
+	// overrides PerSegmentChannels, which is the same as Workers equal to Capacity. Workers beyond
+	// Capacity would serve no segment, so there are at most Capacity workers.
+	Workers int
 	// CanAck is an optional config cooperating with flag arg of Set() and Ack(). It is used in
 	// some special situations.
 	// For example, we need to send user state to another progress and user state only have one field
@@ -38,32 +96,484 @@ type Config[flag any] struct {
 	//      return setT <= ackT
 	// }
 	// When response of first msg arrived, it won't be acked since it not the newest.
+	// LessOrEqual[int64]() provides this CanAck without the type assertion.
 	CanAck CanAck[flag]
+	// TrackContention counts, per segment, lock acquisitions that had to wait for another holder.
+	// The counts are reported by Stats() and tell whether Capacity should be increased. It is off
+	// by default to avoid the overhead.
+	TrackContention bool
+	// TrackAccess counts Set, Ack and Get calls per segment for AccessStats, to spot segments
+	// handling much more traffic than others.
+	TrackAccess bool
+	// Hasher maps message ids to segments. Int64Hasher is used by default, FibonacciHasher spreads
+	// timestamp-like ids better.
+	Hasher Hasher
+	// ConsistentHashing maps hashed ids to segments by a consistent hashing ring instead of modulo,
+	// so Resize moves only a fraction of messages. VirtualNodes is the number of points every
+	// segment owns on the ring, 100 by default. More points spread messages more evenly but
+	// make segment lookup slower.
+	ConsistentHashing bool
+	VirtualNodes      int
+	// OrderedPerKey makes messages set with the same id form a sequence instead of overwriting
+	// each other. Only the oldest message of a sequence is visible to Get and can be acked, the
+	// next one takes its place once it is acked. Every queued message stays in memory until it's
+	// acked, so a producer repeatedly setting the same id without acks grows the queue unbounded.
+	OrderedPerKey bool
+	// MultiFlag records a message made of several parts acked independently. Setting an id again
+	// adds the flag as a new part instead of overwriting the message, and Ack removes the part
+	// matching its flag, by CanAck if it is set or by == otherwise. The message is removed when
+	// all parts are acked. Without CanAck, flag must be a comparable type or Ack panics. It can't
+	// be used with OrderedPerKey.
+	MultiFlag bool
+	// LatencyBuckets are upper bounds of the ack latency histogram returned by LatencyHistogram().
+	// The histogram is disabled if it is empty.
+	LatencyBuckets []time.Duration
+	// CanAckPanicPolicy decides whether a message is kept or removed when CanAck panics, so that
+	// a bug in CanAck doesn't crash the caller in sync mode or the daemon in async mode. The
+	// recovered value is passed to OnPanic if it is set.
+	CanAckPanicPolicy CanAckPanicPolicy
+	OnPanic           func(v any)
+	// RateLimiter optionally throttles Set to protect the downstream. Set fails with ErrRateLimited
+	// when it denies, while SetContext waits for it.
+	RateLimiter Limiter
+	// MaxValueSize rejects Set of values bigger than it with ErrValueTooLarge, so that a single
+	// huge payload can't blow the memory budget. Size of values is measured by SizeOf, and the
+	// check is skipped if either of them is not set.
+	MaxValueSize int
+	SizeOf       func(v val) int
+	// MaxBytes rejects Set with ErrMemoryLimit when the approximate bytes held by pending values,
+	// measured by SizeOf and reported by ApproxBytes, would exceed it. The check is approximate
+	// under concurrent sets, and skipped if either of them is not set.
+	MaxBytes int64
+	// Disabled turns the ack manager into a no-op: Set and Ack succeed instantly without recording
+	// anything, so Get never returns messages. It lets the feature be switched off by config
+	// instead of checks at every call site.
+	Disabled bool
+	// AtMostOnce switches to fire-and-forget delivery: Set still applies MaxValueSize and
+	// RateLimiter but records nothing, so Get never returns anything and Ack becomes a no-op.
+	// It lets a single code path toggle delivery semantics.
+	AtMostOnce bool
+	// MaxTotal limits the number of pending messages across all segments. When a Set exceeds it,
+	// the oldest message is evicted and passed to OnEvict. The oldest message is approximated by
+	// the oldest one of EvictionSamples random segments, 3 by default, so a message slightly
+	// younger than the globally oldest one may be evicted instead. Pinned messages are never
+	// evicted, see Pin. 0 means no limit.
+	MaxTotal        int
+	EvictionSamples int
+	OnEvict         func(m *Msg[flag, val])
+	// OnSet is called every time a message is recorded, by Set in sync mode or by the daemon
+	// goroutine in async mode. It is called outside the segment lock.
+	OnSet func(m *Msg[flag, val])
+	// OnRemove is called once for every message removed from the ack manager, whether it's acked,
+	// dead-lettered, evicted or dropped, with the reason of the removal. It is a single place for
+	// cleanup, called after the specific callbacks like OnEvict and outside the segment lock.
+	// Messages replaced by a Set of the same id are not removed.
+	OnRemove func(m *Msg[flag, val], reason RemoveReason)
+	// SweepInterval enables the sweeper goroutine run by Start, in both sync and async mode. Every
+	// SweepInterval it passes messages not acked within Timeout to Resend, and refreshes their
+	// Timestamp so they are resent again after another Timeout. A message already resent
+	// MaxRetries times is removed and passed to OnDeadLetter instead. Timeout is SweepInterval by
+	// default and MaxRetries of 0 means no limit. The callbacks are called outside segment locks.
+	SweepInterval time.Duration
+	Timeout       time.Duration
+	MaxRetries    int
+	Resend        func(m *Msg[flag, val]) error
+	OnDeadLetter  func(m *Msg[flag, val])
+	// MaxAge is a safety net making sure nothing lingers forever even if resending is broken: the
+	// sweeper removes messages recorded longer than MaxAge ago regardless of their retries, and
+	// passes them to OnDeadLetter. 0 means no limit.
+	MaxAge time.Duration
+	// CallbackConcurrency is the number of Resend calls the sweeper runs in parallel, 1 by
+	// default. The sweeper waits for the calls of a segment before it moves on to the next one,
+	// so it bounds the load a sweep puts on downstream.
+	CallbackConcurrency int
+	// TimeoutFor, if it is set, gives the sweeper the timeout of each message by its flag instead
+	// of Timeout, so messages of different tiers are resent after different timeouts. A result of 0
+	// falls back to Timeout. It is called under the segment lock and must be quick.
+	TimeoutFor func(f flag) time.Duration
+	// Backoff, if it is set, delays the next resend of a message resent by the sweeper by
+	// Backoff(retries) in addition to the timeout, so the gaps between resends can grow with
+	// retries. See ExponentialBackoff.
+	Backoff func(retries int) time.Duration
+	// ResetRetriesOnSet makes setting a message of a pending id reset its Retries to 0. By default
+	// the new message takes over the Retries of the replaced one, so setting the same id again
+	// can't keep a message from reaching MaxRetries.
+	ResetRetriesOnSet bool
+	// TimeoutsBufferSize, if it is more than 0, makes the sweeper also send the messages it
+	// resends to the channel returned by Timeouts, buffered by TimeoutsBufferSize messages.
+	TimeoutsBufferSize int
+	// TimeoutsOverflowPolicy decides what the sweeper does when the Timeouts channel is full. It
+	// waits for the consumer by default, OverflowError drops the message instead.
+	TimeoutsOverflowPolicy OverflowPolicy
+	// CanonicalID, if it is set, maps ids to canonical ids before they are stored or looked up, so
+	// that different ids of the same logical message, like a new id generated by a retry, share
+	// one record. It must return the same id for a canonical id. It is called on every Set, Ack
+	// and lookup by id, so it should be cheap.
+	CanonicalID func(id int64) int64
+	// RecentAcks, if it is more than 0, remembers the ids of the last RecentAcks messages acked,
+	// so that a duplicate ack of them is detected before looking into the segments. Duplicate
+	// acks are counted in Stats and passed to OnDuplicateAck. Setting an id again forgets it.
+	RecentAcks int
+	// OnDuplicateAck, if it is set, is called with the id and the flag of every duplicate ack
+	// detected by RecentAcks.
+	OnDuplicateAck func(id int64, f flag)
+	// FIFO keeps the messages of every segment in a queue in the order they are recorded or
+	// resent, so that Get and the sweeper stop scanning at the first message not expired instead
+	// of scanning all of them. It assumes that this order is the order of timestamps, which is
+	// broken by SetAt with past times, async buffering, OrderedPerKey and TimeoutFor: then some
+	// expired messages are found late, when the messages before them expire. MaxAge is also only
+	// checked for the scanned messages.
+	FIFO bool
+	// TrackChanges versions every change of the pending messages, and keeps tombstones of the
+	// removed ones, for SnapshotSince. It costs an atomic increment per change. Tombstones are
+	// only dropped by SnapshotSince, so MaxTombstones, 100000 by default, bounds them when
+	// SnapshotSince is called rarely or never: the oldest ones are dropped beyond it, and the next
+	// SnapshotSince from before them returns a full snapshot instead.
+	TrackChanges  bool
+	MaxTombstones int
+	// MaxPending, if it is more than 0, bounds the number of pending messages in both modes: Set
+	// waits until acks or expiry bring it below MaxPending, or fails with ErrPendingLimit if
+	// it doesn't wait for the async buffer, like TrySet or with OverflowError. In sync mode a
+	// slot is reserved atomically before recording, so concurrent Sets never exceed it. In async
+	// mode messages still buffered are not counted yet, so the bound can be exceeded by the
+	// buffer size. Setting a pending id also waits although it doesn't add a message.
+	MaxPending int
+	// TraceOps, if it is more than 0, keeps the last TraceOps sets and acks processed with their
+	// outcomes, for RecentOps to debug lost acks. It costs a lock per operation.
+	TraceOps int
+	// GetDeadline, if it is more than 0, bounds how long Get, GetAfter, GetInto and GetPartial scan,
+	// so that a huge ack manager doesn't hold segment locks long enough to starve Set and Ack.
+	// The scan stops once it passes and returns the messages collected so far, see GetPartial.
+	GetDeadline time.Duration
+	// ContextReapers, if it is more than 0, bounds the goroutines removing the messages of
+	// SetWithContext whose context is done. By default each removal runs in the goroutine
+	// context.AfterFunc starts for it, so cancelling a parent context of many messages makes as
+	// many goroutines contend for the segment locks. With ContextReapers they only queue the
+	// messages, and at most ContextReapers of them stay to remove the queued messages.
+	ContextReapers int
+	// Tracer, if it is set, traces Set and Ack. Set spans cover recording the message, including
+	// waiting for the async buffer. Ack spans are started once the message is removed, which is
+	// when its Meta is known, and mark the moment it is acked. Meta maps are copied on Set before
+	// they are passed to the tracer.
+	Tracer Tracer
+	// Logger receives warnings of notable events: messages dropped on async buffer overflow,
+	// evicted or dead-lettered messages, panics recovered from CanAck and the daemon goroutine
+	// stopping. Nothing is logged by default.
+	Logger Logger
+	// CloneValue copies values passed to Set before they are recorded. When val is a pointer, a
+	// slice or a map, the caller mutating it afterwards would corrupt the recorded message, so
+	// CloneValue should make a deep copy. It costs a copy of every value set.
+	CloneValue func(v val) val
+	// Now returns the current time, time.Now by default. Tests can replace it with a fake clock.
+	Now func() time.Time
+	// LockKind selects the lock of segments. LockRW, the default, lets Get and other readers run
+	// concurrently. LockPlain uses sync.Mutex, which is cheaper for write-heavy workloads rarely
+	// calling Get.
+	LockKind LockKind
 }
 
+// LockKind is the kind of segment locks.
+type LockKind int
+
+const (
+	// LockRW uses sync.RWMutex.
+	LockRW LockKind = iota
+	// LockPlain uses sync.Mutex.
+	LockPlain
+)
+
+// Logger is a minimal structured logger, kv are alternating keys and values.
+type Logger interface {
+	Warn(msg string, kv ...any)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Warn(string, ...any) {}
+
+// Tracer creates tracing spans of Set and Ack, e.g. by an OpenTelemetry tracer. The otelack
+// module adapts an OpenTelemetry tracer. It is a separate module, so this one keeps depending on
+// the standard library only.
+type Tracer interface {
+	// StartSpan starts a span of op, "set" or "ack", for the message id as a child of the span of
+	// ctx, and returns the context of the new span and the function ending it. For "set" ctx is
+	// the context passed to SetContext, context.Background for the other setters, and the
+	// context returned is used while waiting for the async buffer. meta is the Meta of the
+	// message to record, and the tracer may inject the span context into it. For "ack" ctx is
+	// context.Background and meta is the Meta of the acked message, so that the span can be
+	// linked to the one of its set.
+	StartSpan(ctx context.Context, op string, id int64, meta map[string]string) (context.Context, func())
+}
+
+// Limiter is a rate limiter, *rate.Limiter of golang.org/x/time/rate satisfies it.
+type Limiter interface {
+	Allow() bool
+	Wait(ctx context.Context) error
+}
+
+// CanAck decides whether a message recorded with setFlag can be acked by ackFlag. Prefer a
+// concrete flag type, like int64 with LessOrEqual, over an interface type: the ack path then
+// doesn't box flags or assert their types, and doesn't allocate.
 type CanAck[flag any] func(setFlag, ackFlag flag) bool
 
+// LessOrEqual returns a CanAck acking messages only if setFlag <= ackFlag. It is the canonical
+// CanAck for timestamp or version flags, see comment in Config field CanAck.
+func LessOrEqual[T cmp.Ordered]() CanAck[T] {
+	return func(setFlag, ackFlag T) bool {
+		return setFlag <= ackFlag
+	}
+}
+
+// Equal returns a CanAck acking messages only if setFlag == ackFlag.
+func Equal[T comparable]() CanAck[T] {
+	return func(setFlag, ackFlag T) bool {
+		return setFlag == ackFlag
+	}
+}
+
+// OverflowPolicy is the behavior of Set and Ack when the async buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits until there is room in the buffer. It is the default.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowError fails with ErrMsgRecordFailed or ErrMsgAckFailed.
+	OverflowError
+)
+
+// DrainPolicy is the behavior of Set while the async buffers are drained.
+type DrainPolicy int
+
+const (
+	// DrainReject fails with ErrDraining. It is the default.
+	DrainReject DrainPolicy = iota
+	// DrainBuffer buffers the message as usual. It is processed by the drain if it is still going
+	// on, otherwise after the next Start.
+	DrainBuffer
+)
+
+// CanAckPanicPolicy is the behavior when CanAck panics.
+type CanAckPanicPolicy int
+
+const (
+	// CanAckPanicKeep treats the panic as "cannot ack" and keeps the message. It is the default.
+	CanAckPanicKeep CanAckPanicPolicy = iota
+	// CanAckPanicForce treats the panic as "can ack" and removes the message.
+	CanAckPanicForce
+)
+
+// status of the goroutines started by Start.
+const (
+	stopped int32 = iota
+	running
+	draining // buffers are drained by StopAndDrain, DrainSetCh or DrainAckCh
+)
+
 type AckManager[flag, val any] struct {
-	capacity int
-	records  []*recorder[flag, val]
-	canAck   CanAck[flag]
+	capacity   int
+	records    []*recorder[flag, val]
+	canAck     CanAck[flag]
+	onPanic    func(v any)
+	logger     Logger
+	tracer     Tracer
+	cloneValue func(v val) val
+	clock      func() time.Time
+	onSet      func(m *Msg[flag, val])
+	onRemove   func(m *Msg[flag, val], reason RemoveReason)
+	hasher     Hasher
+	ring       *ring
+	replicas   int
+	latency    *histogram
+	limiter    Limiter
+	sizeOf     func(v val) int
+	maxSize    int
+	maxBytes   int64
+
+	panicPolicy     CanAckPanicPolicy
+	trackContention bool
+	trackAccess     bool
+	lockKind        LockKind
+	orderedPerKey   bool
+	multiFlag       bool
+	disabled        bool
+	atMostOnce      bool
+
+	resetRetriesOnSet bool
+	getDeadline       time.Duration
+	fifo              bool
+	trackChanges      bool
+	version           uint64 // version of the last change, only used with TrackChanges
+	maxTombstones     int
+	tombstoneFloor    uint64 // version of the last tombstone dropped beyond maxTombstones
+	maxPending        int64
+	roomMu            sync.Mutex
+	roomCh            chan struct{} // closed when pending messages drop below maxPending
+	threshold         atomic.Pointer[threshold]
+	canonicalID       func(id int64) int64
+	recentAcks        *recentAcks
+	opLog             *opLog[flag]
+	onDuplicateAck    func(id int64, f flag)
+
+	// keepOld, if it is set, tells whether a pending message with setFlag old is kept instead of
+	// being replaced by a new one with setFlag new.
+	keepOld func(old, new flag) bool
+
+	reaper *reaper[flag, val]
+
+	maxTotal     int
+	evictSamples int
+	onEvict      func(m *Msg[flag, val])
+
+	// pending is the number of recorded messages and bytes is the size of their values,
+	// emptyCh is closed and replaced every time pending drops to zero.
+	pending int64
+	serials uint64
+	bytes   int64
+	emptyMu sync.Mutex
+	emptyCh chan struct{}
+
+	droppedSets   int64
+	droppedAcks   int64
+	processedSets int64
+	processedAcks int64
+	retries       int64
+	duplicateAcks int64
+	rejectedAcks  int64
+	lastErr       atomic.Value // errBox
+
+	// used by the sweeper
+	sweepInterval time.Duration
+	timeout       time.Duration
+	maxRetries    int
+	resend        func(m *Msg[flag, val]) error
+	onDeadLetter  func(m *Msg[flag, val])
+	maxAge        time.Duration
+	timeoutFor    func(f flag) time.Duration
+	backoff       func(retries int) time.Duration
+
+	callbackConcurrency int
+	timeoutsSize        int
+	timeoutsOverflow    OverflowPolicy
+	timeoutCh           chan *Msg[flag, val]
 
 	// used for async mode
-	async  bool
-	setCh  chan *msg[flag, val]
-	ackCh  chan *msg[flag, val]
-	stopCh chan struct{}
-	status int32
+	async    bool
+	overflow OverflowPolicy
+	drain    DrainPolicy
+	workers  []*worker[flag, val]
+	stopCh   chan struct{}
+	status   int32
+	// lifecycleMu serializes Start with Stop and StopAndDrain, so stopCh is made before the
+	// status is running and closed once.
+	lifecycleMu sync.Mutex
+	// ctx is the context of NewAckManagerContext, Start fails once it is done.
+	ctx context.Context
+	// orderedSetAck buffers acks in setCh.
+	orderedSetAck bool
+	onOverflow    func(m *Msg[flag, val])
+	// goroutines is the number of running daemon and sweeper goroutines.
+	goroutines int32
 }
 
-func NewAckManager[flag, val any](cfg *Config[flag]) (*AckManager[flag, val], error) {
+func NewAckManager[flag, val any](cfg *Config[flag, val]) (*AckManager[flag, val], error) {
 	if cfg.Capacity <= 0 {
 		return nil, errors.New("capacity should be more than 0")
 	}
+	if cfg.OrderedPerKey && cfg.MultiFlag {
+		return nil, errors.New("OrderedPerKey and MultiFlag can't be used together")
+	}
 	am := &AckManager[flag, val]{
-		capacity: cfg.Capacity,
-		records:  make([]*recorder[flag, val], 0, cfg.Capacity),
-		canAck:   cfg.CanAck,
+		capacity:   cfg.Capacity,
+		records:    make([]*recorder[flag, val], 0, cfg.Capacity),
+		canAck:     cfg.CanAck,
+		onPanic:    cfg.OnPanic,
+		logger:     cfg.Logger,
+		tracer:     cfg.Tracer,
+		cloneValue: cfg.CloneValue,
+		clock:      cfg.Now,
+		onSet:      cfg.OnSet,
+		onRemove:   cfg.OnRemove,
+		hasher:     cfg.Hasher,
+		limiter:    cfg.RateLimiter,
+		sizeOf:     cfg.SizeOf,
+		maxSize:    cfg.MaxValueSize,
+		maxBytes:   cfg.MaxBytes,
+		emptyCh:    make(chan struct{}),
+
+		panicPolicy:     cfg.CanAckPanicPolicy,
+		trackContention: cfg.TrackContention,
+		trackAccess:     cfg.TrackAccess,
+		lockKind:        cfg.LockKind,
+		orderedPerKey:   cfg.OrderedPerKey,
+		multiFlag:       cfg.MultiFlag,
+		disabled:        cfg.Disabled,
+		atMostOnce:      cfg.AtMostOnce,
+
+		resetRetriesOnSet: cfg.ResetRetriesOnSet,
+		getDeadline:       cfg.GetDeadline,
+		fifo:              cfg.FIFO,
+		trackChanges:      cfg.TrackChanges,
+		maxTombstones:     cfg.MaxTombstones,
+		maxPending:        int64(cfg.MaxPending),
+		roomCh:            make(chan struct{}),
+		canonicalID:       cfg.CanonicalID,
+		onDuplicateAck:    cfg.OnDuplicateAck,
+	}
+	if cfg.TraceOps > 0 {
+		am.opLog = newOpLog[flag](cfg.TraceOps)
+	}
+	if cfg.RecentAcks > 0 {
+		am.recentAcks = newRecentAcks(cfg.RecentAcks)
+	}
+	if cfg.MaxTotal > 0 {
+		am.maxTotal = cfg.MaxTotal
+		am.evictSamples = cfg.EvictionSamples
+		if am.evictSamples <= 0 {
+			am.evictSamples = 3
+		}
+		am.onEvict = cfg.OnEvict
+	}
+	// the sweep settings are also used by SweepOnce without the sweeper goroutine.
+	am.maxRetries = cfg.MaxRetries
+	am.resend = cfg.Resend
+	am.onDeadLetter = cfg.OnDeadLetter
+	am.maxAge = cfg.MaxAge
+	am.timeoutFor = cfg.TimeoutFor
+	am.backoff = cfg.Backoff
+	am.callbackConcurrency = cfg.CallbackConcurrency
+	if cfg.SweepInterval > 0 {
+		am.sweepInterval = cfg.SweepInterval
+		am.timeout = cfg.Timeout
+		if am.timeout <= 0 {
+			am.timeout = cfg.SweepInterval
+		}
+		am.timeoutsSize = cfg.TimeoutsBufferSize
+		am.timeoutsOverflow = cfg.TimeoutsOverflowPolicy
+	}
+	if am.maxTombstones <= 0 {
+		am.maxTombstones = defaultMaxTombstones
+	}
+	if len(cfg.LatencyBuckets) > 0 {
+		am.latency = newHistogram(cfg.LatencyBuckets)
+	}
+	if cfg.ContextReapers > 0 {
+		am.reaper = &reaper[flag, val]{max: cfg.ContextReapers}
+	}
+	if am.clock == nil {
+		am.clock = time.Now
+	}
+	if am.logger == nil {
+		am.logger = nopLogger{}
+	}
+	if am.hasher == nil {
+		am.hasher = Int64Hasher{}
+	}
+	if cfg.ConsistentHashing {
+		am.replicas = cfg.VirtualNodes
+		if am.replicas <= 0 {
+			am.replicas = 100
+		}
+		am.ring = newRing(cfg.Capacity, am.replicas)
 	}
 	for i := 0; i < cfg.Capacity; i++ {
 		am.records = append(am.records, newRecorder[flag, val](am))
@@ -71,97 +581,1047 @@ func NewAckManager[flag, val any](cfg *Config[flag]) (*AckManager[flag, val], er
 
 	if cfg.Async {
 		am.async = true
-		am.setCh = make(chan *msg[flag, val], cfg.SetBufferSize)
-		am.ackCh = make(chan *msg[flag, val], cfg.AckBufferSize)
+		am.overflow = cfg.OverflowPolicy
+		am.onOverflow = cfg.OnOverflow
+		am.drain = cfg.DrainPolicy
+		am.orderedSetAck = cfg.OrderedSetAck
+		n := 1
+		if cfg.PerSegmentChannels {
+			n = cfg.Capacity
+		}
+		if cfg.Workers > 0 {
+			n = min(cfg.Workers, cfg.Capacity)
+		}
+		for i := 0; i < n; i++ {
+			am.workers = append(am.workers, newWorker[flag, val](cfg.SetBufferSize, cfg.AckBufferSize))
+		}
 	}
 	return am, nil
 }
 
-// Start starts daemon goroutine in async mode.
-func (a *AckManager[flag, val]) Start() {
-	if !a.async || !atomic.CompareAndSwapInt32(&a.status, 0, 1) {
-		return
+// NewAckManagerContext is like NewAckManager but also stops the ack manager when ctx is done, so
+// shutdown needs no wiring by the caller. It only matters when there are goroutines to stop, in
+// async mode or with SweepInterval. ctx is watched by context.AfterFunc, so no goroutine waits
+// for it. Once ctx is done, Start doesn't start the ack manager again.
+func NewAckManagerContext[flag, val any](ctx context.Context, cfg *Config[flag, val]) (*AckManager[flag, val], error) {
+	am, err := NewAckManager(cfg)
+	if err != nil {
+		return nil, err
 	}
+	am.ctx = ctx
+	context.AfterFunc(ctx, func() { am.Stop() })
+	return am, nil
+}
 
+// Start starts daemon goroutine in async mode, and the sweeper goroutine if SweepInterval is set.
+// It returns whether this call started them, false if they are already running, there is
+// nothing to start, or the context of NewAckManagerContext is done.
+func (a *AckManager[flag, val]) Start() bool {
+	a.lifecycleMu.Lock()
+	defer a.lifecycleMu.Unlock()
+	if (!a.async && a.sweepInterval <= 0) || (a.ctx != nil && a.ctx.Err() != nil) || !atomic.CompareAndSwapInt32(&a.status, stopped, running) {
+		return false
+	}
+
+	if n := atomic.LoadInt32(&a.goroutines); n > 0 {
+		a.logger.Warn("goroutines of the previous run are still running", "count", n)
+	}
 	a.stopCh = make(chan struct{})
-	go func() {
+	for _, w := range a.workers {
+		w.doneCh = make(chan struct{})
+		atomic.AddInt32(&a.goroutines, 1)
+		go a.daemon(w, a.stopCh, w.doneCh)
+	}
+	if a.sweepInterval > 0 {
+		if a.timeoutsSize > 0 {
+			a.timeoutCh = make(chan *Msg[flag, val], a.timeoutsSize)
+		}
+		atomic.AddInt32(&a.goroutines, 1)
+		go a.sweeper(a.stopCh, a.timeoutCh)
+	}
+	return true
+}
+
+// GoroutineCount returns the number of daemon and sweeper goroutines running, e.g. for tests to
+// check that Start and Stop don't leak goroutines. Goroutines exit shortly after Stop, not at once.
+func (a *AckManager[flag, val]) GoroutineCount() int {
+	return int(atomic.LoadInt32(&a.goroutines))
+}
+
+// daemon processes messages buffered in w until stopCh is closed, then it closes doneCh. Both
+// are of the run it is started by, as the next Start replaces them while it may still be exiting.
+func (a *AckManager[flag, val]) daemon(w *worker[flag, val], stopCh, doneCh chan struct{}) {
+	defer atomic.AddInt32(&a.goroutines, -1)
+	defer close(doneCh)
+	for {
 		select {
-		case m := <-a.setCh:
-			a.set(m.ID, m.Flag, m.Value)
-		case m := <-a.ackCh:
-			a.ack(m.ID, m.Flag)
-		case <-a.stopCh:
+		case m := <-w.setCh:
+			a.processSet(m)
+		case m := <-w.ackCh:
+			a.processAck(m)
+		case <-stopCh:
+			a.logger.Warn("daemon goroutine stopped")
 			return
 		}
-	}()
+	}
 }
 
-// Stop stops daemon goroutine in async mode.
-func (a *AckManager[flag, val]) Stop() {
-	if !a.async || !atomic.CompareAndSwapInt32(&a.status, 1, 0) {
+// processSet records a set taken from the async buffer.
+func (a *AckManager[flag, val]) processSet(m *Msg[flag, val]) {
+	if m.isAck {
+		a.processAck(m)
 		return
 	}
+	a.set(m)
+	atomic.AddInt64(&a.processedSets, 1)
+}
+
+// processAck applies an ack taken from the async buffer.
+func (a *AckManager[flag, val]) processAck(m *Msg[flag, val]) {
+	acked := a.ack(m.ID, m.Flag)
+	if m.reply != nil {
+		m.reply <- acked != nil
+	}
+	atomic.AddInt64(&a.processedAcks, 1)
+}
+
+// Stop stops the goroutines started by Start. It returns whether this call stopped them, false
+// if they are not running, so it is safe to call from several places.
+func (a *AckManager[flag, val]) Stop() bool {
+	return a.stop(stopped)
+}
+
+// stop moves the status from running to status and closes stopCh, and reports whether it did.
+func (a *AckManager[flag, val]) stop(status int32) bool {
+	a.lifecycleMu.Lock()
+	defer a.lifecycleMu.Unlock()
+	if !atomic.CompareAndSwapInt32(&a.status, running, status) {
+		return false
+	}
 	close(a.stopCh)
+	return true
 }
 
+// StopAndDrain is like Stop but also processes the messages still buffered in async mode.
+// If ctx is done before the buffers are empty, the unprocessed messages are returned together
+// with ctx.Err() so that the caller can persist them. Buffered sets come first, followed by
+// buffered acks which carry no Timestamp and Value.
+func (a *AckManager[flag, val]) StopAndDrain(ctx context.Context) ([]*Msg[flag, val], error) {
+	if !a.async {
+		a.Stop()
+		return nil, nil
+	}
+	switch {
+	case a.stop(draining):
+		defer atomic.StoreInt32(&a.status, stopped)
+		for _, w := range a.workers {
+			select {
+			case <-w.doneCh:
+			case <-ctx.Done():
+				return a.remaining(), ctx.Err()
+			}
+		}
+	case atomic.CompareAndSwapInt32(&a.status, stopped, draining):
+		defer atomic.StoreInt32(&a.status, stopped)
+	}
+
+	for _, w := range a.workers {
+		for drained := false; !drained; {
+			if ctx.Err() != nil {
+				return a.remaining(), ctx.Err()
+			}
+			select {
+			case m := <-w.setCh:
+				a.processSet(m)
+			case m := <-w.ackCh:
+				a.processAck(m)
+			default:
+				drained = true
+			}
+		}
+	}
+	return nil, nil
+}
+
+// IsDraining reports whether the async buffers are being drained by StopAndDrain, DrainSetCh or
+// DrainAckCh.
+func (a *AckManager[flag, val]) IsDraining() bool {
+	return atomic.LoadInt32(&a.status) == draining
+}
+
+// DrainSetCh records all sets currently buffered in async mode and returns the number of them.
+// It lets tests apply async sets deterministically, or a backlog be processed once on shutdown.
+// It fails with ErrRunning if the daemon goroutine is running.
+func (a *AckManager[flag, val]) DrainSetCh() (int, error) {
+	return a.drainCh(func(w *worker[flag, val]) chan *Msg[flag, val] { return w.setCh }, a.processSet)
+}
+
+// DrainAckCh is like DrainSetCh but processes buffered acks.
+func (a *AckManager[flag, val]) DrainAckCh() (int, error) {
+	return a.drainCh(func(w *worker[flag, val]) chan *Msg[flag, val] { return w.ackCh }, a.processAck)
+}
+
+// drainCh processes messages currently buffered in the channel chosen by ch of every worker.
+func (a *AckManager[flag, val]) drainCh(ch func(*worker[flag, val]) chan *Msg[flag, val],
+	process func(*Msg[flag, val])) (int, error) {
+	if !a.async {
+		return 0, nil
+	}
+	if !atomic.CompareAndSwapInt32(&a.status, stopped, draining) {
+		return 0, ErrRunning
+	}
+	defer atomic.StoreInt32(&a.status, stopped)
+
+	n := 0
+	for _, w := range a.workers {
+		c := ch(w)
+	drain:
+		for buffered := len(c); buffered > 0; buffered-- {
+			select {
+			case m := <-c:
+				process(m)
+				n++
+			default:
+				break drain
+			}
+		}
+	}
+	return n, nil
+}
+
+// remaining takes all messages out of the async buffers without processing them. Acks of AckAsync
+// among them receive false.
+func (a *AckManager[flag, val]) remaining() []*Msg[flag, val] {
+	var res, acks []*Msg[flag, val]
+	for _, w := range a.workers {
+		for _, m := range takeAll(w.setCh, nil) {
+			// acks share the set buffer with OrderedSetAck.
+			if m.isAck {
+				acks = append(acks, m)
+			} else {
+				res = append(res, m)
+			}
+		}
+	}
+	res = append(res, acks...)
+	for _, w := range a.workers {
+		res = takeAll(w.ackCh, res)
+	}
+	for _, m := range res {
+		if m.reply != nil {
+			m.reply <- false
+		}
+	}
+	return res
+}
+
+// Set records a message. In async mode the message is buffered, and when the buffer is full
+// Set waits for room or fails with ErrMsgRecordFailed, according to OverflowPolicy.
 func (a *AckManager[flag, val]) Set(id int64, f flag, v val) error {
-	if a.async {
-		m := &msg[flag, val]{
-			ID:        id,
-			Timestamp: time.Now().UnixNano(),
-			Flag:      f,
-			Value:     v,
+	return a.SetAt(id, f, v, a.clock())
+}
+
+// SetAt is like Set but records the message with timestamp ts instead of the current time, e.g.
+// an authoritative creation time carried from upstream. Timestamp decides when Get reports the
+// message, so clock skew between the producer and this process makes it reported earlier or
+// later than expected.
+func (a *AckManager[flag, val]) SetAt(id int64, f flag, v val, ts time.Time) error {
+	return a.setMsg(a.newMsg(id, f, v, ts.UnixNano()), a.overflow == OverflowBlock)
+}
+
+// Entry is a message to record by SetBatch.
+type Entry[flag, val any] struct {
+	ID    int64
+	Flag  flag
+	Value val
+	// Timestamp is the time the message is sent, the time SetBatch is called if it is zero.
+	Timestamp time.Time
+}
+
+// SetBatch records the messages of batch like Set, and returns the number of them recorded before
+// the first failure. Each message keeps its own Timestamp, captured before it's buffered in async
+// mode, so timeouts of batched messages are measured from their own send times.
+func (a *AckManager[flag, val]) SetBatch(batch []Entry[flag, val]) (int, error) {
+	now := a.now()
+	for i, e := range batch {
+		ts := now
+		if !e.Timestamp.IsZero() {
+			ts = e.Timestamp.UnixNano()
 		}
-		select {
-		case a.setCh <- m:
-			return nil
-		default:
-			return ErrMsgRecordFailed
+		if err := a.setMsg(a.newMsg(e.ID, e.Flag, e.Value, ts), a.overflow == OverflowBlock); err != nil {
+			return i, err
 		}
 	}
+	return len(batch), nil
+}
+
+// SetWithMeta is like Set but also attaches meta to the message, e.g. a trace id, so that it is
+// carried through resends without being part of the value.
+func (a *AckManager[flag, val]) SetWithMeta(id int64, f flag, v val, meta map[string]string) error {
+	m := a.newMsg(id, f, v, a.now())
+	m.Meta = meta
+	return a.setMsg(m, a.overflow == OverflowBlock)
+}
 
-	a.set(id, f, v)
+// TrySet is like Set but never waits. It fails with ErrMsgRecordFailed when the async buffer is
+// full regardless of OverflowPolicy.
+func (a *AckManager[flag, val]) TrySet(id int64, f flag, v val) error {
+	return a.setMsg(a.newMsg(id, f, v, a.now()), false)
+}
+
+func (a *AckManager[flag, val]) setMsg(m *Msg[flag, val], block bool) error {
+	if a.disabled {
+		return nil
+	}
+	if err := a.admit(m.Value); err != nil {
+		return err
+	}
+	if a.limiter != nil && !a.limiter.Allow() {
+		return ErrRateLimited
+	}
+	return a.record(context.Background(), m, block)
+}
+
+// SetContext is like Set but waits for the rate limiter instead of failing with ErrRateLimited.
+// Waiting for the rate limiter or room in the async buffer is aborted when ctx is done.
+func (a *AckManager[flag, val]) SetContext(ctx context.Context, id int64, f flag, v val) error {
+	if a.disabled {
+		return nil
+	}
+	if err := a.admit(v); err != nil {
+		return err
+	}
+	if a.limiter != nil {
+		if err := a.limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return a.record(ctx, a.newMsg(id, f, v, a.now()), a.overflow == OverflowBlock)
+}
+
+// SetWithContext is like Set but ties the message to ctx, e.g. of a request: it is removed when
+// ctx is done, unless it has been acked or set again before. No goroutine waits for ctx until it
+// is done, as it's watched by context.AfterFunc, but ctx holds the message until then. When ctx
+// is done a goroutine is started to remove the message, see ContextReapers to bound them. In
+// async mode a message still buffered when ctx is done is kept.
+func (a *AckManager[flag, val]) SetWithContext(ctx context.Context, id int64, f flag, v val) error {
+	m := a.newMsg(id, f, v, a.now())
+	if err := a.setMsg(m, a.overflow == OverflowBlock); err != nil {
+		return err
+	}
+	context.AfterFunc(ctx, func() { a.reap(m) })
 	return nil
 }
 
-func (a *AckManager[flag, val]) set(id int64, f flag, v val) {
-	index := id % int64(a.capacity)
-	a.records[index].Set(id, f, v)
+// now returns the current time in nanoseconds.
+func (a *AckManager[flag, val]) now() int64 {
+	return a.clock().UnixNano()
 }
 
-func (a *AckManager[flag, val]) Ack(id int64, f flag) error {
+// newMsg builds a message to record, copying v by cloneValue if it is set.
+func (a *AckManager[flag, val]) newMsg(id int64, f flag, v val, ts int64) *Msg[flag, val] {
+	if a.cloneValue != nil {
+		v = a.cloneValue(v)
+	}
+	m := newMsg(a.canonical(id), f, v, ts)
+	m.serial = a.nextSerial()
+	return m
+}
+
+// nextSerial returns a new serial for a message to record. Unlike timestamps, serials tell apart
+// messages set with the same id at the same time, e.g. by SetAt or a fake clock.
+func (a *AckManager[flag, val]) nextSerial() uint64 {
+	return atomic.AddUint64(&a.serials, 1)
+}
+
+// CanonicalID returns the id under which the message of id is stored, which is id itself unless
+// Config field CanonicalID is set.
+func (a *AckManager[flag, val]) CanonicalID(id int64) int64 {
+	return a.canonical(id)
+}
+
+// canonical maps id to its canonical id by canonicalID.
+func (a *AckManager[flag, val]) canonical(id int64) int64 {
+	if a.canonicalID == nil {
+		return id
+	}
+	return a.canonicalID(id)
+}
+
+// admit checks whether the value can be recorded.
+func (a *AckManager[flag, val]) admit(v val) error {
+	if a.sizeOf == nil {
+		return nil
+	}
+	size := a.sizeOf(v)
+	if a.maxSize > 0 && size > a.maxSize {
+		return ErrValueTooLarge
+	}
+	if a.maxBytes > 0 && atomic.LoadInt64(&a.bytes)+int64(size) > a.maxBytes {
+		return ErrMemoryLimit
+	}
+	return nil
+}
+
+// record sends the message to the buffer in async mode, or records it in sync mode.
+func (a *AckManager[flag, val]) record(ctx context.Context, m *Msg[flag, val], block bool) error {
+	if a.atMostOnce {
+		return nil
+	}
+	if a.maxPending > 0 {
+		if err := a.waitRoom(ctx, block, !a.async); err != nil {
+			return err
+		}
+		m.reserved = !a.async
+	}
+	if a.tracer != nil {
+		m.Meta = maps.Clone(m.Meta)
+		if m.Meta == nil {
+			m.Meta = map[string]string{}
+		}
+		var end func()
+		ctx, end = a.tracer.StartSpan(ctx, "set", m.ID, m.Meta)
+		defer end()
+	}
 	if a.async {
-		m := &msg[flag, val]{
-			ID:   id,
-			Flag: f,
+		if a.drain == DrainReject && a.IsDraining() {
+			return ErrDraining
 		}
+		return a.send(ctx, a.worker(m.ID).setCh, m, block, &a.droppedSets, ErrMsgRecordFailed)
+	}
+
+	a.set(m)
+	return nil
+}
+
+// send puts m into the async buffer ch. When ch is full, it waits for room until ctx is done if
+// block is set, otherwise it counts m as dropped and fails with errFull.
+func (a *AckManager[flag, val]) send(ctx context.Context, ch chan *Msg[flag, val], m *Msg[flag, val], block bool,
+	dropped *int64, errFull error) error {
+	if block {
 		select {
-		case a.ackCh <- m:
+		case ch <- m:
 			return nil
-		default:
-			return ErrMsgAckFailed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	select {
+	case ch <- m:
+		return nil
+	default:
+		atomic.AddInt64(dropped, 1)
+		a.logger.Warn(errFull.Error(), "id", m.ID, "len", len(ch), "cap", cap(ch))
+		if a.onOverflow != nil {
+			a.onOverflow(m)
 		}
+		return &AckError{Err: errFull, Len: len(ch), Cap: cap(ch)}
+	}
+}
+
+func (a *AckManager[flag, val]) set(m *Msg[flag, val]) setOutcome {
+	if a.sizeOf != nil {
+		m.size = int64(a.sizeOf(m.Value))
+	}
+	reserved := m.reserved
+	outcome := a.segment(m.ID).Set(m)
+	if reserved && outcome != setRecorded && a.release(1) {
+		// the slot reserved by waitRoom is given back as m didn't add a message.
+		a.notifyEmpty()
+	}
+	if a.opLog != nil {
+		a.traceOp(false, m.ID, m.Flag, outcome.op())
+	}
+	if outcome == setKeptOld {
+		return outcome
+	}
+	if a.onSet != nil {
+		a.onSet(m)
+	}
+	if a.maxTotal > 0 && outcome == setRecorded {
+		a.evict()
+	}
+	return outcome
+}
+
+// SetResult is like Set but also reports whether a pending message with the same id is replaced.
+// It is only supported in sync mode and fails with ErrAsync in async mode.
+func (a *AckManager[flag, val]) SetResult(id int64, f flag, v val) (overwritten bool, err error) {
+	if a.disabled {
+		return false, nil
+	}
+	if a.async {
+		return false, ErrAsync
+	}
+	if err := a.admit(v); err != nil {
+		return false, err
+	}
+	if a.limiter != nil && !a.limiter.Allow() {
+		return false, ErrRateLimited
+	}
+	if a.atMostOnce {
+		return false, nil
+	}
+	m := a.newMsg(id, f, v, a.now())
+	if a.maxPending > 0 {
+		if err := a.waitRoom(context.Background(), true, true); err != nil {
+			return false, err
+		}
+		m.reserved = true
+	}
+	return a.set(m) == setOverwritten, nil
+}
+
+// Ack removes the message of id if CanAck allows. In async mode the ack is buffered, and when the
+// buffer is full Ack waits for room or fails with ErrMsgAckFailed, according to OverflowPolicy.
+func (a *AckManager[flag, val]) Ack(id int64, f flag) error {
+	return a.ackMsg(id, f, a.overflow == OverflowBlock)
+}
+
+// AckMsg acks by a message echoed back in a response, taking its ID and Flag like Set does.
+func (a *AckManager[flag, val]) AckMsg(m *Msg[flag, val]) error {
+	return a.Ack(m.ID, m.Flag)
+}
+
+// TryAck is like Ack but never waits. It fails with ErrMsgAckFailed when the async buffer is full
+// regardless of OverflowPolicy.
+func (a *AckManager[flag, val]) TryAck(id int64, f flag) error {
+	return a.ackMsg(id, f, false)
+}
+
+func (a *AckManager[flag, val]) ackMsg(id int64, f flag, block bool) error {
+	if a.disabled || a.atMostOnce {
+		return nil
+	}
+	id = a.canonical(id)
+	if a.async {
+		m := &Msg[flag, val]{
+			ID:    id,
+			Flag:  f,
+			isAck: true,
+		}
+		return a.send(context.Background(), a.ackCh(id), m, block, &a.droppedAcks, ErrMsgAckFailed)
 	}
 
 	a.ack(id, f)
 	return nil
 }
 
-func (a *AckManager[flag, val]) ack(id int64, f flag) {
-	index := id % int64(a.capacity)
-	a.records[index].Remove(id, f)
+// AckAsync is like Ack but returns a channel receiving whether the message is removed, once the
+// ack is processed. In async mode the ack is buffered as usual, and false is sent at once if the
+// buffer is full and the ack is dropped, or later if it is taken out of the buffer unprocessed by
+// StopAndDrain or Reset. The channel is buffered, so it can be abandoned without leaking anything.
+// An ack still buffered after Stop gets its result once it's processed after the next Start.
+func (a *AckManager[flag, val]) AckAsync(id int64, f flag) <-chan bool {
+	reply := make(chan bool, 1)
+	if a.disabled || a.atMostOnce {
+		reply <- false
+		return reply
+	}
+	id = a.canonical(id)
+	if !a.async {
+		reply <- a.ack(id, f) != nil
+		return reply
+	}
+	m := &Msg[flag, val]{
+		ID:    id,
+		Flag:  f,
+		isAck: true,
+		reply: reply,
+	}
+	err := a.send(context.Background(), a.ackCh(id), m, a.overflow == OverflowBlock, &a.droppedAcks,
+		ErrMsgAckFailed)
+	if err != nil {
+		reply <- false
+	}
+	return reply
+}
+
+// AckTimed is like Ack but always works synchronously, and returns how long the message was
+// pending since it was set or last resent, the same latency LatencyHistogram observes. It reports
+// whether the message is removed.
+func (a *AckManager[flag, val]) AckTimed(id int64, f flag) (time.Duration, bool) {
+	if a.disabled || a.atMostOnce {
+		return 0, false
+	}
+	m := a.ack(a.canonical(id), f)
+	if m == nil {
+		return 0, false
+	}
+	return time.Duration(a.now() - m.Timestamp), true
+}
+
+// CompareAndAck atomically checks CanAck, calls onAck with the stored message if it can be acked,
+// and removes it, all under the segment write lock. It closes the gap where the message may change
+// between a GetByID and an Ack. It reports whether the message is removed, and always works
+// synchronously. onAck must not call back into the ack manager.
+func (a *AckManager[flag, val]) CompareAndAck(id int64, ackFlag flag, onAck func(stored *Msg[flag, val])) bool {
+	id = a.canonical(id)
+	return a.segment(id).Remove(id, ackFlag, onAck) != nil
+}
+
+// AckBefore acks all messages with Timestamp before ts, like a cumulative ack of a checkpoint,
+// and returns the number of removed messages. f is the ack flag passed to CanAck for each of them.
+// Messages are removed as a whole in MultiFlag mode. It always works synchronously.
+func (a *AckManager[flag, val]) AckBefore(ts int64, f flag) int {
+	n := 0
+	for _, r := range a.records {
+		n += r.AckWhere(func(m *Msg[flag, val]) bool { return m.Timestamp < ts }, f)
+	}
+	return n
+}
+
+// AckRange acks all messages with ids in [lo, hi], like an ack of a window, and returns the
+// number of removed messages. f is the ack flag passed to CanAck for each of them. All segments
+// are scanned as ids are spread across them. It always works synchronously.
+func (a *AckManager[flag, val]) AckRange(lo, hi int64, f flag) int {
+	n := 0
+	for _, r := range a.records {
+		n += r.AckWhere(func(m *Msg[flag, val]) bool { return m.ID >= lo && m.ID <= hi }, f)
+	}
+	return n
+}
+
+// ack removes the message of id if it can be acked by f, and returns it, or nil if it is not
+// removed.
+func (a *AckManager[flag, val]) ack(id int64, f flag) *Msg[flag, val] {
+	if a.recentAcks != nil && a.recentAcks.Contains(id) {
+		atomic.AddInt64(&a.duplicateAcks, 1)
+		if a.onDuplicateAck != nil {
+			a.onDuplicateAck(id, f)
+		}
+		a.traceOp(true, id, f, OpDuplicate)
+		return nil
+	}
+	r := a.segment(id)
+	m := r.Remove(id, f, nil)
+	if m == nil {
+		if a.opLog != nil {
+			outcome := OpNotFound
+			if _, ok := r.GetByID(id); ok {
+				outcome = OpRejected
+			}
+			a.traceOp(true, id, f, outcome)
+		}
+		return nil
+	}
+	a.traceAck(m)
+	a.traceOp(true, id, f, OpAcked)
+	if a.recentAcks != nil {
+		// in OrderedPerKey mode the next queued message of id takes the place of the acked one.
+		if _, queued := r.GetByID(id); !queued {
+			a.recentAcks.Add(id)
+		}
+	}
+	return m
+}
+
+// traceAck traces the ack of m if it is acked.
+func (a *AckManager[flag, val]) traceAck(m *Msg[flag, val]) {
+	if a.tracer != nil && m != nil {
+		_, end := a.tracer.StartSpan(context.Background(), "ack", m.ID, m.Meta)
+		end()
+	}
+}
+
+// callCanAck calls canAck and recovers the panic from it according to panicPolicy. The recovered
+// value is returned as p.
+func (a *AckManager[flag, val]) callCanAck(setFlag, ackFlag flag) (ok bool, p any) {
+	defer func() {
+		if p = recover(); p != nil {
+			ok = a.panicPolicy == CanAckPanicForce
+		}
+	}()
+	return a.canAck(setFlag, ackFlag), nil
+}
+
+// recovered reports the panic recovered from canAck.
+func (a *AckManager[flag, val]) recovered(p any) {
+	a.logger.Warn("CanAck panicked", "panic", p)
+	if a.onPanic != nil {
+		a.onPanic(p)
+	}
+}
+
+// segment returns the recorder the message id is hashed to.
+func (a *AckManager[flag, val]) segment(id int64) *recorder[flag, val] {
+	return a.records[a.index(id)]
+}
+
+// index returns index of the segment the message id is hashed to.
+func (a *AckManager[flag, val]) index(id int64) int {
+	if a.capacity == 1 {
+		return 0
+	}
+	h := a.hasher.Hash(id)
+	if a.ring != nil {
+		return a.ring.get(h)
+	}
+	return int(h % uint64(a.capacity))
+}
+
+// Get returns messages not acked after duration nanoseconds, except the ones leased until a
+// later NotBefore, see GetAll. It is the low-level primitive of
+// GetAfter, which takes a time.Duration and should be preferred. The result may be partial if
+// GetDeadline is set, see GetPartial.
+func (a *AckManager[flag, val]) Get(duration int64) []*Msg[flag, val] {
+	return a.GetInto(duration, nil)
+}
+
+// GetAfter returns messages not acked after d. It is equal to Get(d.Nanoseconds()), and avoids
+// the common mistake of passing seconds to Get.
+func (a *AckManager[flag, val]) GetAfter(d time.Duration) []*Msg[flag, val] {
+	return a.Get(d.Nanoseconds())
+}
+
+// HasExpired reports whether Get(duration) would return any message, but stops at the first one
+// found. Segments whose oldest message is not expired are skipped without a scan, so it's cheap
+// enough to decide whether a retry pass is needed at all.
+func (a *AckManager[flag, val]) HasExpired(duration int64) bool {
+	if duration <= 0 {
+		return false
+	}
+	now := a.now()
+	for _, r := range a.records {
+		if r.HasExpired(duration, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAll is like Get but also returns the leased messages, whose NotBefore is not reached yet,
+// if includeLeased is true. It gives monitoring a full view without affecting resends.
+func (a *AckManager[flag, val]) GetAll(duration int64, includeLeased bool) []*Msg[flag, val] {
+	if !includeLeased {
+		return a.Get(duration)
+	}
+	now := a.now()
+	return a.GetWhere(func(m *Msg[flag, val]) bool {
+		return now < m.NotBefore || (duration > 0 && now-m.Timestamp >= duration)
+	})
+}
+
+// GetInto is like Get but reuses dst: it truncates dst, appends the messages to it and returns
+// the result. Callers retrying in a loop can pass the previous result back to avoid allocation.
+func (a *AckManager[flag, val]) GetInto(duration int64, dst []*Msg[flag, val]) []*Msg[flag, val] {
+	dst, _ = a.getInto(duration, dst)
+	return dst
+}
+
+// GetPartial is like Get but also reports whether the result is partial because the scan took
+// longer than GetDeadline. Messages not scanned before the deadline are missing from a partial
+// result, later calls may return them.
+func (a *AckManager[flag, val]) GetPartial(duration int64) ([]*Msg[flag, val], bool) {
+	return a.getInto(duration, nil)
+}
+
+func (a *AckManager[flag, val]) getInto(duration int64, dst []*Msg[flag, val]) ([]*Msg[flag, val], bool) {
+	var deadline time.Time
+	if a.getDeadline > 0 {
+		deadline = time.Now().Add(a.getDeadline)
+	}
+	dst = dst[:0]
+	for _, r := range a.records {
+		var partial bool
+		if dst, partial = r.GetInto(duration, dst, deadline); partial {
+			return dst, true
+		}
+	}
+	return dst, false
+}
+
+// GetAndRefresh is like Get but also refreshes Timestamp of the returned messages to now in the
+// same locked pass, so they won't be returned again until another duration passes. It fuses the
+// common "get expired, resend and reset their clocks" retry steps.
+func (a *AckManager[flag, val]) GetAndRefresh(duration int64) []*Msg[flag, val] {
+	var res []*Msg[flag, val]
+	for _, r := range a.records {
+		res = r.GetAndRefresh(duration, res)
+	}
+	return res
+}
+
+// ProcessExpired calls fn for each message not acked after duration, e.g. to resend it. The
+// message is acked if fn returns true, otherwise its Timestamp is refreshed so it won't be picked
+// up again until another duration passes. Each segment is processed under its write lock, so fn
+// must not call back into the ack manager and should be quick.
+func (a *AckManager[flag, val]) ProcessExpired(duration int64, fn func(*Msg[flag, val]) (ack bool)) {
+	for _, r := range a.records {
+		r.ProcessExpired(duration, fn)
+	}
+}
+
+// GetGrouped is like Get but returns messages of each segment in a separate slice, so they can be
+// dispatched to dedicated workers without re-sharding. The result has one slice per segment, and
+// the slice of a segment without expired messages is empty.
+func (a *AckManager[flag, val]) GetGrouped(duration int64) [][]*Msg[flag, val] {
+	res := make([][]*Msg[flag, val], len(a.records))
+	for i, r := range a.records {
+		res[i], _ = r.GetInto(duration, nil, time.Time{})
+	}
+	return res
+}
+
+// GetByID returns a copy of the pending message of id, and whether it exists.
+func (a *AckManager[flag, val]) GetByID(id int64) (*Msg[flag, val], bool) {
+	id = a.canonical(id)
+	return a.segment(id).GetByID(id)
+}
+
+// Flag returns the flag of the pending message of id, and whether it exists.
+func (a *AckManager[flag, val]) Flag(id int64) (flag, bool) {
+	id = a.canonical(id)
+	return a.segment(id).Flag(id)
 }
 
-func (a *AckManager[flag, val]) Get(duration int64) []*msg[flag, val] {
-	var res []*msg[flag, val]
+// Value returns the value of the pending message of id, and whether it exists.
+func (a *AckManager[flag, val]) Value(id int64) (val, bool) {
+	id = a.canonical(id)
+	return a.segment(id).Value(id)
+}
+
+// GetWhere returns all pending messages for which pred is true. pred is evaluated under the
+// segment read lock, so it must not call back into the ack manager or it will deadlock.
+func (a *AckManager[flag, val]) GetWhere(pred func(*Msg[flag, val]) bool) []*Msg[flag, val] {
+	var res []*Msg[flag, val]
 	for _, r := range a.records {
-		res = append(res, r.Get(duration)...)
+		res = r.GetWhere(pred, res, 0)
 	}
 	return res
 }
 
+// GetWhereN is like GetWhere but returns at most max messages, e.g. to process the expired
+// messages of one tenant at a time so that a noisy tenant can't monopolize the retry loop. The
+// scan starts from a random segment so that no segment is favored when max is reached.
+func (a *AckManager[flag, val]) GetWhereN(pred func(*Msg[flag, val]) bool, max int) []*Msg[flag, val] {
+	if max <= 0 {
+		return nil
+	}
+	var res []*Msg[flag, val]
+	start := rand.IntN(len(a.records))
+	for i := range a.records {
+		if res = a.records[(start+i)%len(a.records)].GetWhere(pred, res, max); len(res) >= max {
+			break
+		}
+	}
+	return res
+}
+
+// Len returns the number of pending messages.
+func (a *AckManager[flag, val]) Len() int {
+	return int(atomic.LoadInt64(&a.pending))
+}
+
+// Oldest returns the pending message waiting for ack the longest, and false if there is no
+// pending message. It takes O(capacity) unless the oldest message of a segment has been removed
+// or refreshed since the last call.
+func (a *AckManager[flag, val]) Oldest() (*Msg[flag, val], bool) {
+	var oldest *Msg[flag, val]
+	for _, r := range a.records {
+		if m := r.Oldest(); m != nil && (oldest == nil || m.Timestamp < oldest.Timestamp) {
+			oldest = m
+		}
+	}
+	return oldest, oldest != nil
+}
+
+// OldestAge returns how long the oldest pending message has been waiting for ack, or 0 if there
+// is no pending message.
+func (a *AckManager[flag, val]) OldestAge() time.Duration {
+	oldest, ok := a.Oldest()
+	if !ok {
+		return 0
+	}
+	return time.Duration(a.now() - oldest.Timestamp)
+}
+
+// ForEach calls fn for each pending message until fn returns false. fn is called under the
+// segment read lock, so it must not call back into the ack manager.
+func (a *AckManager[flag, val]) ForEach(fn func(*Msg[flag, val]) bool) {
+	for _, r := range a.records {
+		if !r.ForEach(fn) {
+			return
+		}
+	}
+}
+
+// ApproxBytes returns the approximate bytes held by pending values, as measured by SizeOf. It is
+// always 0 if SizeOf is not set.
+func (a *AckManager[flag, val]) ApproxBytes() int64 {
+	return atomic.LoadInt64(&a.bytes)
+}
+
+// WaitEmpty blocks until there is no pending message or ctx is done. It returns as soon as the
+// last pending message is acked.
+func (a *AckManager[flag, val]) WaitEmpty(ctx context.Context) error {
+	for {
+		ch := a.emptySignal()
+		if a.Len() == 0 {
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Empty returns a channel closed the next time pending messages drop to zero, so pipelines can
+// react to it without polling Len. Call Empty again for the following transition. The channel is
+// not closed if there is no pending message when it's called and none is set later, and since
+// messages may be set right after the transition, Len may be non-zero by the time the receiver
+// wakes up. Use WaitEmpty to wait for an empty state instead.
+func (a *AckManager[flag, val]) Empty() <-chan struct{} {
+	return a.emptySignal()
+}
+
+// emptySignal returns the channel closed on the next time pending messages drop to zero.
+func (a *AckManager[flag, val]) emptySignal() chan struct{} {
+	a.emptyMu.Lock()
+	ch := a.emptyCh
+	a.emptyMu.Unlock()
+	return ch
+}
+
+// release counts n pending messages as removed, wakes up the Set calls waiting for room if they
+// can continue, and reports whether pending messages drop to zero.
+func (a *AckManager[flag, val]) release(n int) bool {
+	pending := atomic.AddInt64(&a.pending, -int64(n))
+	if a.maxPending > 0 && pending < a.maxPending && pending+int64(n) >= a.maxPending {
+		a.roomMu.Lock()
+		close(a.roomCh)
+		a.roomCh = make(chan struct{})
+		a.roomMu.Unlock()
+	}
+	a.crossedLow(pending)
+	return pending == 0
+}
+
+// waitRoom waits until pending messages are less than maxPending or ctx is done. It fails with
+// ErrPendingLimit at once if block is not set. If reserve is set, it also counts a pending message
+// in the same atomic step, so concurrent calls can't exceed maxPending. The message to record
+// must then be marked reserved, and set gives the slot back if it doesn't add a message.
+func (a *AckManager[flag, val]) waitRoom(ctx context.Context, block, reserve bool) error {
+	for {
+		a.roomMu.Lock()
+		ch := a.roomCh
+		a.roomMu.Unlock()
+		if pending := atomic.LoadInt64(&a.pending); pending < a.maxPending {
+			if !reserve || atomic.CompareAndSwapInt64(&a.pending, pending, pending+1) {
+				return nil
+			}
+			continue
+		}
+		if !block {
+			return ErrPendingLimit
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notifyEmpty wakes up everyone waiting for pending messages to drop to zero.
+func (a *AckManager[flag, val]) notifyEmpty() {
+	a.emptyMu.Lock()
+	close(a.emptyCh)
+	a.emptyCh = make(chan struct{})
+	a.emptyMu.Unlock()
+}
+
+// ExtractWhere removes all pending messages for which pred is true and returns them, e.g. to hand
+// off a tenant's messages to another ack manager with Restore. Each segment is processed
+// atomically under its write lock, so pred must not call back into the ack manager. In
+// OrderedPerKey mode pred is called with the oldest message of each id, and the messages queued
+// behind it are extracted with it in order, so Restore queues them again in the same sequence.
+func (a *AckManager[flag, val]) ExtractWhere(pred func(*Msg[flag, val]) bool) []*Msg[flag, val] {
+	var res []*Msg[flag, val]
+	for _, r := range a.records {
+		res = r.ExtractWhere(pred, res)
+	}
+	return res
+}
+
+// Restore records copies of msgs as they are, keeping their Timestamp and Retries. It records
+// synchronously in both modes and skips the checks of Set, like MaxValueSize and RateLimiter.
+func (a *AckManager[flag, val]) Restore(msgs []*Msg[flag, val]) {
+	for _, m := range msgs {
+		c := *m
+		c.serial = a.nextSerial()
+		a.set(&c)
+	}
+}
+
+// ToMap returns copies of all pending messages in a single map keyed by id, which is handy for
+// tests and debugging. It copies every message, so it's O(n) in the number of pending messages.
+// Only the oldest message of each id is included in OrderedPerKey mode.
+func (a *AckManager[flag, val]) ToMap() map[int64]*Msg[flag, val] {
+	res := make(map[int64]*Msg[flag, val], a.Len())
+	a.ForEach(func(m *Msg[flag, val]) bool {
+		c := *m
+		res[m.ID] = &c
+		return true
+	})
+	return res
+}
+
+// FromMap records copies of the messages in msgs like Restore. It is the inverse of ToMap.
+func (a *AckManager[flag, val]) FromMap(msgs map[int64]*Msg[flag, val]) {
+	a.Restore(slices.Collect(maps.Values(msgs)))
+}
+
+// DrainTo removes all pending messages and calls fn for each of them, e.g. to persist them on
+// shutdown. fn is called under the segment write lock, so it must not call back into the ack
+// manager.
+func (a *AckManager[flag, val]) DrainTo(fn func(*Msg[flag, val])) {
+	for _, r := range a.records {
+		r.DrainTo(fn)
+	}
+}
+
+// Reset drops all pending and buffered messages and clears the counters, returning the ack
+// manager to the state right after it is created. It fails with ErrRunning if the daemon
+// goroutine is running.
+func (a *AckManager[flag, val]) Reset() error {
+	if atomic.LoadInt32(&a.status) != stopped {
+		return ErrRunning
+	}
+	if a.async {
+		a.remaining()
+	}
+	for _, r := range a.records {
+		r.Reset()
+	}
+	a.ResetStats()
+	a.lastErr.Store(errBox{})
+	return nil
+}
+
+// ReAllocate rebuilds maps of the segments that have shrunk to less than half of their peak
+// size, to release the memory held by deleted messages. Stable segments are skipped.
 func (a *AckManager[flag, val]) ReAllocate() {
 	for _, v := range a.records {
-		v.ReAllocate()
+		v.ReAllocate(false)
+	}
+}
+
+// ReAllocateForce rebuilds maps of all segments.
+func (a *AckManager[flag, val]) ReAllocateForce() {
+	for _, v := range a.records {
+		v.ReAllocate(true)
+	}
+}
+
+// Prewarm sizes the maps of the segments for n pending messages in total, so that a known burst
+// of messages, e.g. at startup, doesn't stall on map growth. It only affects the capacity of the
+// maps, not their contents, and a later ReAllocate may shrink them again.
+func (a *AckManager[flag, val]) Prewarm(n int) {
+	size := (n + len(a.records) - 1) / len(a.records)
+	for _, v := range a.records {
+		v.Prewarm(size)
 	}
 }
@@ -0,0 +1,1423 @@
+package ack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock for Config field Now that only moves when tests advance it.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1_000_000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestSetWithContextRemovesOnCancel(t *testing.T) {
+	removed := make(chan RemoveReason, 1)
+	am, err := NewAckManager(&Config[int64, int]{
+		Capacity: 2,
+		OnRemove: func(m *Msg[int64, int], reason RemoveReason) { removed <- reason },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	am.SetWithContext(ctx, 1, 0, 1)
+	cancel()
+	select {
+	case reason := <-removed:
+		if reason != RemoveCanceled {
+			t.Fatalf("reason = %v, want %v", reason, RemoveCanceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not removed after cancel")
+	}
+	if am.Len() != 0 {
+		t.Fatalf("Len = %d, want 0", am.Len())
+	}
+}
+
+func TestSetWithContextKeepsMessageSetAgain(t *testing.T) {
+	clock := newFakeClock()
+	am, err := NewAckManager(&Config[int64, int]{Capacity: 2, Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	am.SetWithContext(ctx, 1, 0, 1)
+	am.Set(1, 0, 2) // same id at the same time
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	if v, ok := am.Value(1); !ok || v != 2 {
+		t.Fatalf("Value = %v, %v, want the message set again", v, ok)
+	}
+}
+
+// waitFor fails the test if cond doesn't become true within a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNewAckManagerContextStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	am, err := NewAckManagerContext(ctx, &Config[int64, int]{Capacity: 2, Async: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	am.Start()
+	if n := am.GoroutineCount(); n != 1 {
+		t.Fatalf("GoroutineCount = %d, want 1", n)
+	}
+	cancel()
+	waitFor(t, "the daemon to exit", func() bool { return am.GoroutineCount() == 0 })
+	if am.Stop() {
+		t.Fatal("Stop = true after cancel, want false")
+	}
+	if am.Start() {
+		t.Fatal("Start = true after cancel, want false")
+	}
+	if n := am.GoroutineCount(); n != 0 {
+		t.Fatalf("GoroutineCount after restart = %d, want 0", n)
+	}
+
+	// ctx done before the first Start.
+	am, _ = NewAckManagerContext(ctx, &Config[int64, int]{Capacity: 2, Async: true})
+	if am.Start() {
+		t.Fatal("Start = true with a done ctx, want false")
+	}
+	if n := am.GoroutineCount(); n != 0 {
+		t.Fatalf("GoroutineCount = %d, want 0", n)
+	}
+}
+
+func TestStartStopConcurrently(t *testing.T) {
+	am, err := NewAckManager(&Config[int64, int]{Capacity: 2, Async: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Go(func() {
+			for j := 0; j < 100; j++ {
+				am.Start()
+				am.Stop()
+			}
+		})
+	}
+	wg.Wait()
+	am.Stop()
+	waitFor(t, "goroutines to exit", func() bool { return am.GoroutineCount() == 0 })
+}
+
+// result receives from ch, failing the test if nothing comes within a second.
+func result(t *testing.T, ch <-chan bool) bool {
+	t.Helper()
+	select {
+	case ok := <-ch:
+		return ok
+	case <-time.After(time.Second):
+		t.Fatal("no result")
+		return false
+	}
+}
+
+func TestAckAsync(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		am, err := NewAckManager(&Config[int64, int]{
+			Capacity:      2,
+			Async:         async,
+			SetBufferSize: 8,
+			AckBufferSize: 8,
+			CanAck:        LessOrEqual[int64](),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		am.Start()
+		am.Set(1, 5, 0)
+		waitFor(t, "the set", func() bool { return am.Len() == 1 })
+		if result(t, am.AckAsync(1, 4)) {
+			t.Errorf("async %v: ack rejected by CanAck confirmed", async)
+		}
+		if !result(t, am.AckAsync(1, 5)) {
+			t.Errorf("async %v: ack not confirmed", async)
+		}
+		if result(t, am.AckAsync(1, 5)) {
+			t.Errorf("async %v: ack of an id not pending confirmed", async)
+		}
+		am.Stop()
+	}
+}
+
+func TestAckAsyncDiscarded(t *testing.T) {
+	am, err := NewAckManager(&Config[int64, int]{Capacity: 2, Async: true, AckBufferSize: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := am.AckAsync(1, 0)
+	am.Reset()
+	if result(t, reply) {
+		t.Fatal("ack discarded by Reset confirmed")
+	}
+
+	reply = am.AckAsync(1, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if rest, _ := am.StopAndDrain(ctx); len(rest) != 1 {
+		t.Fatalf("StopAndDrain returned %d messages, want 1", len(rest))
+	}
+	if result(t, reply) {
+		t.Fatal("ack left by StopAndDrain confirmed")
+	}
+}
+
+type spanKey struct{}
+
+// span is a span started by mockTracer.
+type span struct {
+	op     string
+	id     int64
+	name   string
+	parent string
+	link   string
+	ended  bool
+}
+
+// mockTracer propagates span names by contexts and Meta like an OpenTelemetry adapter would.
+type mockTracer struct {
+	mu    sync.Mutex
+	spans []*span
+}
+
+func (t *mockTracer) StartSpan(ctx context.Context, op string, id int64, meta map[string]string) (context.Context, func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &span{op: op, id: id, name: fmt.Sprintf("%s-%d", op, len(t.spans))}
+	s.parent, _ = ctx.Value(spanKey{}).(string)
+	if op == "set" {
+		meta["span"] = s.name
+	} else {
+		s.link = meta["span"]
+	}
+	t.spans = append(t.spans, s)
+	return context.WithValue(ctx, spanKey{}, s.name), func() {
+		t.mu.Lock()
+		s.ended = true
+		t.mu.Unlock()
+	}
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &mockTracer{}
+	a, err := NewAckManager(&Config[int, string]{Capacity: 2, Tracer: tracer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), spanKey{}, "request")
+	if err := a.SetContext(ctx, 1, 0, "v"); err != nil {
+		t.Fatal(err)
+	}
+	meta := map[string]string{"k": "v"}
+	a.SetWithMeta(2, 0, "v", meta)
+	a.Ack(1, 0)
+	a.Ack(2, 0)
+	a.Ack(3, 0)
+
+	want := []span{
+		{op: "set", id: 1, name: "set-0", parent: "request", ended: true},
+		{op: "set", id: 2, name: "set-1", ended: true},
+		{op: "ack", id: 1, name: "ack-2", link: "set-0", ended: true},
+		{op: "ack", id: 2, name: "ack-3", link: "set-1", ended: true},
+	}
+	if len(tracer.spans) != len(want) {
+		t.Fatalf("got %d spans, want %d", len(tracer.spans), len(want))
+	}
+	for i, s := range tracer.spans {
+		if *s != want[i] {
+			t.Errorf("span %d = %+v, want %+v", i, *s, want[i])
+		}
+	}
+	if len(meta) != 1 {
+		t.Errorf("meta passed to SetWithMeta = %v, want it unchanged", meta)
+	}
+}
+
+func TestStopAndDrainTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	a, err := NewAckManager(&Config[int, string]{
+		Capacity:      2,
+		Async:         true,
+		SetBufferSize: 8,
+		AckBufferSize: 8,
+		CanAck: func(setFlag, ackFlag int) bool {
+			<-unblock
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Start()
+	defer close(unblock)
+	a.Set(1, 0, "v")
+	waitFor(t, "message 1 recorded", func() bool { return a.Len() == 1 })
+	// the daemon is paused in CanAck by this ack.
+	a.Ack(1, 0)
+	waitFor(t, "ack of message 1 taken", func() bool { return len(a.workers[0].ackCh) == 0 })
+	a.Set(2, 0, "v")
+	a.Ack(3, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	rest, err := a.StopAndDrain(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("StopAndDrain error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if len(rest) != 2 || rest[0].ID != 2 || rest[0].isAck || rest[1].ID != 3 || !rest[1].isAck {
+		t.Fatalf("StopAndDrain returned %v, want the set of 2 then the ack of 3", rest)
+	}
+}
+
+func TestGetIntoReuses(t *testing.T) {
+	clock := newFakeClock()
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 4, Now: clock.Now})
+	for id := int64(0); id < 100; id++ {
+		a.Set(id, 0, "v")
+	}
+	clock.Add(time.Second)
+	dst := a.GetInto(1, nil)
+	if len(dst) != 100 {
+		t.Fatalf("GetInto returned %d messages, want 100", len(dst))
+	}
+	if allocs := testing.AllocsPerRun(10, func() { dst = a.GetInto(1, dst) }); allocs != 0 {
+		t.Fatalf("GetInto allocated %v times reusing dst, want 0", allocs)
+	}
+}
+
+func BenchmarkGetInto(b *testing.B) {
+	clock := newFakeClock()
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 16, Now: clock.Now})
+	for id := int64(0); id < 10_000; id++ {
+		a.Set(id, 0, "v")
+	}
+	clock.Add(time.Second)
+	dst := a.GetInto(1, nil)
+	b.ReportAllocs()
+	for b.Loop() {
+		dst = a.GetInto(1, dst)
+	}
+}
+
+func TestCanAckPanicPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		policy CanAckPanicPolicy
+		async  bool
+		kept   bool
+	}{
+		{"keep", CanAckPanicKeep, false, true},
+		{"force", CanAckPanicForce, false, false},
+		{"keep async", CanAckPanicKeep, true, true},
+		{"force async", CanAckPanicForce, true, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var panics []any
+			a, err := NewAckManager(&Config[int, string]{
+				Capacity:      2,
+				Async:         tt.async,
+				SetBufferSize: 8,
+				AckBufferSize: 8,
+				CanAck: func(setFlag, ackFlag int) bool {
+					if ackFlag < 0 {
+						panic("bad flag")
+					}
+					return true
+				},
+				CanAckPanicPolicy: tt.policy,
+				OnPanic: func(v any) {
+					mu.Lock()
+					panics = append(panics, v)
+					mu.Unlock()
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.Start()
+			defer a.Stop()
+			a.Set(1, 0, "v")
+			a.Set(2, 0, "v")
+			waitFor(t, "messages recorded", func() bool { return a.Len() == 2 })
+			a.Ack(1, -1)
+			waitFor(t, "panic reported", func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return len(panics) == 1
+			})
+			if panics[0] != "bad flag" {
+				t.Fatalf("OnPanic got %v, want the value of the panic", panics[0])
+			}
+			if _, ok := a.GetByID(1); ok != tt.kept {
+				t.Fatalf("message found = %v after CanAck panicked, want %v", ok, tt.kept)
+			}
+			// the daemon survives the panic.
+			a.Ack(2, 0)
+			waitFor(t, "message 2 acked", func() bool {
+				_, ok := a.GetByID(2)
+				return !ok
+			})
+		})
+	}
+}
+
+func TestReset(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2, Async: true, SetBufferSize: 8, AckBufferSize: 8})
+	a.Start()
+	a.Set(1, 0, "v")
+	a.Set(2, 0, "v")
+	waitFor(t, "messages recorded", func() bool { return a.Len() == 2 })
+	if err := a.Reset(); err != ErrRunning {
+		t.Fatalf("Reset while running = %v, want %v", err, ErrRunning)
+	}
+	a.Stop()
+	waitFor(t, "daemon stopped", func() bool { return a.GoroutineCount() == 0 })
+	a.Set(3, 0, "v")
+	a.Ack(1, 0)
+
+	if err := a.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if a.Len() != 0 || len(a.workers[0].setCh) != 0 || len(a.workers[0].ackCh) != 0 {
+		t.Fatalf("Len = %d with buffered %d sets and %d acks after Reset, want nothing",
+			a.Len(), len(a.workers[0].setCh), len(a.workers[0].ackCh))
+	}
+	if s := a.Stats(); s.ProcessedSets != 0 {
+		t.Fatalf("ProcessedSets = %d after Reset, want 0", s.ProcessedSets)
+	}
+
+	a.Start()
+	defer a.Stop()
+	a.Set(4, 0, "v")
+	waitFor(t, "message 4 recorded", func() bool { return a.Len() == 1 })
+	a.Ack(4, 0)
+	waitFor(t, "message 4 acked", func() bool { return a.Len() == 0 })
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// bucket is a Limiter of tokens refilled by tests.
+type bucket struct {
+	tokens chan struct{}
+}
+
+func newBucket(tokens int) *bucket {
+	b := &bucket{tokens: make(chan struct{}, 16)}
+	b.refill(tokens)
+	return b
+}
+
+func (b *bucket) refill(n int) {
+	for range n {
+		b.tokens <- struct{}{}
+	}
+}
+
+func (b *bucket) Allow() bool {
+	select {
+	case <-b.tokens:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *bucket) Wait(ctx context.Context) error {
+	select {
+	case <-b.tokens:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newBucket(2)
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2, RateLimiter: limiter})
+	for id := int64(1); id <= 2; id++ {
+		if err := a.Set(id, 0, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Set(3, 0, "v"); err != ErrRateLimited {
+		t.Fatalf("Set beyond the rate = %v, want %v", err, ErrRateLimited)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := a.SetContext(ctx, 3, 0, "v"); err != context.DeadlineExceeded {
+		t.Fatalf("SetContext beyond the rate = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	done := make(chan error)
+	go func() { done <- a.SetContext(context.Background(), 3, 0, "v") }()
+	limiter.refill(1)
+	if err := <-done; err != nil {
+		t.Fatalf("SetContext after refill = %v", err)
+	}
+	if a.Len() != 3 {
+		t.Fatalf("Len = %d, want 3", a.Len())
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:     2,
+		MaxValueSize: 4,
+		SizeOf:       func(v string) int { return len(v) },
+	})
+	if err := a.Set(1, 0, "four"); err != nil {
+		t.Fatalf("Set at the limit = %v", err)
+	}
+	if err := a.Set(2, 0, "fives"); err != ErrValueTooLarge {
+		t.Fatalf("Set over the limit = %v, want %v", err, ErrValueTooLarge)
+	}
+	if err := a.SetContext(context.Background(), 2, 0, "fives"); err != ErrValueTooLarge {
+		t.Fatalf("SetContext over the limit = %v, want %v", err, ErrValueTooLarge)
+	}
+	if a.Len() != 1 {
+		t.Fatalf("Len = %d, want only the message at the limit", a.Len())
+	}
+}
+
+func TestSetResult(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2})
+	if overwritten, err := a.SetResult(1, 0, "one"); err != nil || overwritten {
+		t.Fatalf("SetResult of a new id = %v, %v, want an insert", overwritten, err)
+	}
+	if overwritten, err := a.SetResult(1, 0, "uno"); err != nil || !overwritten {
+		t.Fatalf("SetResult of a pending id = %v, %v, want an overwrite", overwritten, err)
+	}
+	if v, _ := a.Value(1); v != "uno" || a.Len() != 1 {
+		t.Fatalf("Value = %q with Len %d, want the overwriting message only", v, a.Len())
+	}
+
+	async, _ := NewAckManager(&Config[int, string]{Capacity: 2, Async: true})
+	if _, err := async.SetResult(1, 0, "one"); err != ErrAsync {
+		t.Fatalf("SetResult in async mode = %v, want %v", err, ErrAsync)
+	}
+}
+
+func TestDrainTo(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 4, MultiFlag: true})
+	for id := int64(0); id < 20; id++ {
+		a.Set(id, 0, "v")
+	}
+	// a second part of a message is drained with it.
+	a.Set(3, 1, "v")
+	seen := map[int64]int{}
+	a.DrainTo(func(m *Msg[int, string]) { seen[m.ID]++ })
+	if len(seen) != 20 {
+		t.Fatalf("fn saw %d ids, want 20", len(seen))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Fatalf("fn saw message %d %d times, want once", id, n)
+		}
+	}
+	if a.Len() != 0 {
+		t.Fatalf("Len = %d after DrainTo, want 0", a.Len())
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlagAndValue(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2})
+	a.Set(1, 7, "one")
+	if f, ok := a.Flag(1); !ok || f != 7 {
+		t.Fatalf("Flag(1) = %d, %v, want 7", f, ok)
+	}
+	if v, ok := a.Value(1); !ok || v != "one" {
+		t.Fatalf("Value(1) = %q, %v, want one", v, ok)
+	}
+	if f, ok := a.Flag(2); ok || f != 0 {
+		t.Fatalf("Flag of an absent id = %d, %v, want the zero flag", f, ok)
+	}
+	if v, ok := a.Value(2); ok || v != "" {
+		t.Fatalf("Value of an absent id = %q, %v, want the zero value", v, ok)
+	}
+}
+
+func TestCanAckHelpers(t *testing.T) {
+	le := LessOrEqual[int64]()
+	for _, tt := range []struct {
+		setFlag, ackFlag int64
+		want             bool
+	}{{1, 2, true}, {2, 2, true}, {3, 2, false}} {
+		if got := le(tt.setFlag, tt.ackFlag); got != tt.want {
+			t.Errorf("LessOrEqual(%d, %d) = %v, want %v", tt.setFlag, tt.ackFlag, got, tt.want)
+		}
+	}
+	eq := Equal[string]()
+	if !eq("a", "a") || eq("a", "b") {
+		t.Error("Equal doesn't match only equal flags")
+	}
+
+	a, _ := NewAckManager(&Config[int64, string]{Capacity: 2, CanAck: LessOrEqual[int64]()})
+	a.Set(1, 5, "v")
+	a.Ack(1, 4)
+	if a.Len() != 1 {
+		t.Fatal("message acked by an older flag")
+	}
+	a.Ack(1, 5)
+	if a.Len() != 0 {
+		t.Fatal("message not acked by its own flag")
+	}
+}
+
+func TestTrySetAndTryAck(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2})
+	if err := a.TrySet(1, 0, "v"); err != nil || a.Len() != 1 {
+		t.Fatalf("TrySet in sync mode = %v with Len %d", err, a.Len())
+	}
+	if err := a.TryAck(1, 0); err != nil || a.Len() != 0 {
+		t.Fatalf("TryAck in sync mode = %v with Len %d", err, a.Len())
+	}
+
+	a, _ = NewAckManager(&Config[int, string]{Capacity: 2, Async: true, SetBufferSize: 1, AckBufferSize: 1})
+	a.Set(1, 0, "v")
+	a.Ack(1, 0)
+	if err := a.TrySet(2, 0, "v"); !errors.Is(err, ErrMsgRecordFailed) {
+		t.Fatalf("TrySet on a full buffer = %v, want %v", err, ErrMsgRecordFailed)
+	}
+	if err := a.TryAck(2, 0); !errors.Is(err, ErrMsgAckFailed) {
+		t.Fatalf("TryAck on a full buffer = %v, want %v", err, ErrMsgAckFailed)
+	}
+
+	// Set and Ack wait for room with OverflowBlock.
+	done := make(chan struct{})
+	go func() {
+		a.Set(2, 0, "v")
+		a.Ack(2, 0)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Set and Ack didn't wait for room in full buffers")
+	case <-time.After(10 * time.Millisecond):
+	}
+	a.Start()
+	defer a.Stop()
+	<-done
+}
+
+func TestGetAndRefresh(t *testing.T) {
+	clock := newFakeClock()
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2, Now: clock.Now})
+	a.Set(1, 0, "v")
+	clock.Add(time.Second)
+	a.Set(2, 0, "v")
+	timeout := int64(time.Second)
+	if got := a.GetAndRefresh(timeout); len(got) != 1 || got[0].ID != 1 {
+		t.Fatalf("GetAndRefresh = %v, want message 1", got)
+	}
+	if got := a.GetAndRefresh(timeout); len(got) != 0 {
+		t.Fatalf("GetAndRefresh right after = %v, want nothing", got)
+	}
+	if got := a.Get(timeout); len(got) != 0 {
+		t.Fatalf("Get right after GetAndRefresh = %v, want nothing", got)
+	}
+	clock.Add(time.Second)
+	if got := a.GetAndRefresh(timeout); len(got) != 2 {
+		t.Fatalf("GetAndRefresh a timeout later = %v, want both messages", got)
+	}
+}
+
+func TestAckBefore(t *testing.T) {
+	for _, canAck := range []CanAck[int]{nil, LessOrEqual[int]()} {
+		clock := newFakeClock()
+		a, _ := NewAckManager(&Config[int, string]{Capacity: 4, Now: clock.Now, CanAck: canAck})
+		var checkpoint int64
+		for id := int64(0); id < 10; id++ {
+			if id == 6 {
+				checkpoint = clock.Now().UnixNano()
+			}
+			a.Set(id, int(id), "v")
+			clock.Add(time.Second)
+		}
+		// messages 0 to 5, across all segments, were sent before the checkpoint.
+		want, f := 6, 9
+		if canAck != nil {
+			want, f = 3, 2
+		}
+		if n := a.AckBefore(checkpoint, f); n != want {
+			t.Fatalf("CanAck %v: AckBefore removed %d messages, want %d", canAck != nil, n, want)
+		}
+		for id := int64(0); id < 10; id++ {
+			if _, ok := a.GetByID(id); ok != (id >= int64(want)) {
+				t.Fatalf("CanAck %v: message %d pending = %v after AckBefore", canAck != nil, id, ok)
+			}
+		}
+	}
+}
+
+func TestCapacityOne(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		clock := newFakeClock()
+		a, err := NewAckManager(&Config[int, string]{
+			Capacity:      1,
+			Async:         async,
+			SetBufferSize: 8,
+			AckBufferSize: 8,
+			Hasher:        FibonacciHasher{},
+			Now:           clock.Now,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Start()
+		for _, id := range []int64{-3, 0, 1, 1 << 40} {
+			if i := a.index(id); i != 0 {
+				t.Fatalf("async %v: index(%d) = %d, want 0", async, id, i)
+			}
+			a.Set(id, 0, "v")
+		}
+		waitFor(t, "messages recorded", func() bool { return a.Len() == 4 })
+		clock.Add(time.Second)
+		if got := a.Get(1); len(got) != 4 {
+			t.Fatalf("async %v: Get = %v, want all 4 messages", async, got)
+		}
+		a.Ack(0, 0)
+		a.Ack(-3, 0)
+		waitFor(t, "messages acked", func() bool { return a.Len() == 2 })
+		if _, ok := a.GetByID(1 << 40); !ok {
+			t.Fatalf("async %v: message %d lost", async, int64(1<<40))
+		}
+		if err := a.Verify(); err != nil {
+			t.Fatalf("async %v: %v", async, err)
+		}
+		a.Stop()
+	}
+}
+
+func TestAckDoesNotAllocate(t *testing.T) {
+	a, _ := NewAckManager(&Config[int64, string]{Capacity: 4, CanAck: LessOrEqual[int64]()})
+	for id := int64(0); id < 200; id++ {
+		a.Set(id, 1, "v")
+	}
+	id := int64(0)
+	if allocs := testing.AllocsPerRun(100, func() {
+		a.Ack(id, 0) // rejected
+		a.Ack(id, 1)
+		id++
+	}); allocs != 0 {
+		t.Fatalf("Ack with a concrete flag allocated %v times, want 0", allocs)
+	}
+	if a.Len() != 99 {
+		t.Fatalf("Len = %d, want 99", a.Len())
+	}
+}
+
+// BenchmarkAck acks pending messages with an int64 flag and LessOrEqual, which shouldn't allocate.
+func BenchmarkAck(b *testing.B) {
+	a, _ := NewAckManager(&Config[int64, string]{Capacity: 16, CanAck: LessOrEqual[int64]()})
+	for id := range int64(b.N) {
+		a.Set(id, 1, "v")
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for id := range int64(b.N) {
+		a.Ack(id, 1)
+	}
+}
+
+func TestAtMostOnce(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		a, _ := NewAckManager(&Config[int, string]{
+			Capacity:      2,
+			Async:         async,
+			SetBufferSize: 8,
+			AckBufferSize: 8,
+			AtMostOnce:    true,
+			MaxValueSize:  4,
+			SizeOf:        func(v string) int { return len(v) },
+		})
+		for id := int64(0); id < 5; id++ {
+			if err := a.Set(id, 0, "v"); err != nil {
+				t.Fatalf("async %v: Set = %v", async, err)
+			}
+		}
+		if err := a.Set(5, 0, "fives"); err != ErrValueTooLarge {
+			t.Fatalf("async %v: Set of a large value = %v, want %v", async, err, ErrValueTooLarge)
+		}
+		a.Ack(1, 0)
+		if async && (len(a.workers[0].setCh) != 0 || len(a.workers[0].ackCh) != 0) {
+			t.Fatalf("async %v: messages buffered", async)
+		}
+		if a.Len() != 0 || len(a.GetWhere(func(*Msg[int, string]) bool { return true })) != 0 || a.ApproxBytes() != 0 {
+			t.Fatalf("async %v: Len = %d, messages retained", async, a.Len())
+		}
+	}
+}
+
+func TestApproxBytes(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity: 2,
+		SizeOf:   func(v string) int { return len(v) },
+		MaxBytes: 10,
+		MaxTotal: 3,
+	})
+	check := func(what string, want int64) {
+		t.Helper()
+		if got := a.ApproxBytes(); got != want {
+			t.Fatalf("ApproxBytes = %d after %s, want %d", got, what, want)
+		}
+		if err := a.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Set(1, 0, "aaa")
+	a.Set(2, 0, "bb")
+	check("sets", 5)
+	a.Set(1, 0, "a")
+	check("an overwrite", 3)
+	a.Ack(2, 0)
+	check("an ack", 1)
+	if err := a.Set(3, 0, "cccccccccc"); err != ErrMemoryLimit {
+		t.Fatalf("Set beyond MaxBytes = %v, want %v", err, ErrMemoryLimit)
+	}
+	check("a rejected set", 1)
+	a.Set(3, 0, "ccc")
+	a.Set(4, 0, "dd")
+	a.Set(5, 0, "e")
+	// message 1 or another one is evicted beyond MaxTotal.
+	var want int64
+	a.ForEach(func(m *Msg[int, string]) bool {
+		want += int64(len(m.Value))
+		return true
+	})
+	if a.Len() != 3 {
+		t.Fatalf("Len = %d, want MaxTotal", a.Len())
+	}
+	check("an eviction", want)
+}
+
+func TestCompareAndAckRace(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, int]{Capacity: 2, CanAck: LessOrEqual[int]()})
+	const n = 2000
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for f := 1; f <= n; f++ {
+			a.Set(1, f, f)
+		}
+	})
+	acked := 0
+	wg.Go(func() {
+		for f := 0; f < n; {
+			m, ok := a.GetByID(1)
+			if !ok {
+				continue
+			}
+			f = m.Flag
+			var stored *Msg[int, int]
+			removed := a.CompareAndAck(1, f, func(s *Msg[int, int]) { stored = s })
+			if removed != (stored != nil) {
+				t.Errorf("CompareAndAck = %v but onAck got %v", removed, stored)
+				return
+			}
+			if removed {
+				acked++
+				// a newer message set since GetByID can't be acked by the older flag.
+				if stored.Flag > f || stored.Value != stored.Flag {
+					t.Errorf("acked message %+v by flag %d", *stored, f)
+					return
+				}
+			}
+		}
+	})
+	wg.Wait()
+	if acked == 0 {
+		t.Fatal("nothing acked")
+	}
+}
+
+func TestStartStopRepeated(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2, Async: true})
+	if a.Stop() {
+		t.Fatal("Stop before Start = true, want false")
+	}
+	if !a.Start() || a.Start() {
+		t.Fatal("Start didn't report starting only the first time")
+	}
+	if !a.Stop() || a.Stop() || a.Stop() {
+		t.Fatal("Stop didn't report stopping only the first time")
+	}
+	if !a.Start() || !a.Stop() {
+		t.Fatal("Start and Stop after a restart = false, want true")
+	}
+
+	s, _ := NewAckManager(&Config[int, string]{Capacity: 2})
+	if s.Start() || s.Stop() {
+		t.Fatal("Start or Stop = true in sync mode without a sweeper, want false")
+	}
+}
+
+func TestOldest(t *testing.T) {
+	clock := newFakeClock()
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 4, Now: clock.Now})
+	if _, ok := a.Oldest(); ok || a.OldestAge() != 0 {
+		t.Fatal("Oldest found a message in an empty manager")
+	}
+	// ids in every segment, the oldest ones not in the first segment.
+	for _, id := range []int64{7, 2, 5, 0, 3} {
+		a.Set(id, 0, "v")
+		clock.Add(time.Second)
+	}
+	oldest := func(want int64) {
+		t.Helper()
+		if m, ok := a.Oldest(); !ok || m.ID != want {
+			t.Fatalf("Oldest = %v, %v, want message %d", m, ok, want)
+		}
+	}
+	oldest(7)
+	if age := a.OldestAge(); age != 5*time.Second {
+		t.Fatalf("OldestAge = %v, want 5s", age)
+	}
+	a.Ack(7, 0)
+	oldest(2)
+	// a refreshed message is no longer the oldest.
+	a.GetAndRefresh(int64(4 * time.Second))
+	oldest(5)
+}
+
+func TestGetDeadline(t *testing.T) {
+	const n = 100_000
+	for _, deadline := range []time.Duration{0, time.Nanosecond} {
+		clock := newFakeClock()
+		a, _ := NewAckManager(&Config[int, string]{Capacity: 1, Now: clock.Now, GetDeadline: deadline})
+		for id := range int64(n) {
+			a.Set(id, 0, "v")
+		}
+		clock.Add(time.Second)
+		got, partial := a.GetPartial(1)
+		if partial != (deadline > 0) {
+			t.Fatalf("GetDeadline %v: partial = %v", deadline, partial)
+		}
+		if partial && (len(got) == 0 || len(got) >= n) || !partial && len(got) != n {
+			t.Fatalf("GetDeadline %v: got %d messages with partial = %v", deadline, len(got), partial)
+		}
+		// Get is bounded the same way.
+		if all := a.Get(1); (len(all) < n) != partial {
+			t.Fatalf("GetDeadline %v: Get returned %d messages", deadline, len(all))
+		}
+	}
+}
+
+func TestSetWithMeta(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		clock := newFakeClock()
+		a, _ := NewAckManager(&Config[int, string]{
+			Capacity:      2,
+			Async:         async,
+			SetBufferSize: 8,
+			AckBufferSize: 8,
+			Now:           clock.Now,
+		})
+		a.SetWithMeta(1, 0, "v", map[string]string{"trace": "abc", "attempt": "1"})
+		a.DrainSetCh()
+		clock.Add(time.Second)
+		a.SweepOnce(1)
+		got := a.Get(1)
+		if len(got) != 0 {
+			t.Fatalf("async %v: Get right after a resend = %v", async, got)
+		}
+		m, ok := a.GetByID(1)
+		if !ok || m.Retries != 1 || m.Value != "v" || len(m.Meta) != 2 || m.Meta["trace"] != "abc" ||
+			m.Meta["attempt"] != "1" {
+			t.Fatalf("async %v: message %+v, want its meta kept through a resend", async, m)
+		}
+		a.Set(2, 0, "v")
+		a.DrainSetCh()
+		if m, _ := a.GetByID(2); m.Meta != nil {
+			t.Fatalf("async %v: meta %v of a message set without it", async, m.Meta)
+		}
+	}
+}
+
+func TestCanonicalID(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:    4,
+		CanonicalID: func(id int64) int64 { return id % 100 },
+	})
+	a.Set(101, 0, "first")
+	a.Set(1, 0, "retry")
+	if a.Len() != 1 {
+		t.Fatalf("Len = %d, want the two raw ids in one record", a.Len())
+	}
+	if m, ok := a.GetByID(201); !ok || m.ID != 1 || m.Value != "retry" {
+		t.Fatalf("GetByID by another raw id = %v, %v, want the record of canonical id 1", m, ok)
+	}
+	if a.CanonicalID(101) != 1 {
+		t.Fatalf("CanonicalID(101) = %d, want 1", a.CanonicalID(101))
+	}
+	a.Ack(301, 0)
+	if a.Len() != 0 {
+		t.Fatal("ack by another raw id didn't remove the record")
+	}
+}
+
+func TestGoroutineCount(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:      6,
+		Async:         true,
+		Workers:       3,
+		SweepInterval: time.Hour,
+	})
+	for range 3 {
+		a.Start()
+		if n := a.GoroutineCount(); n != 4 {
+			t.Fatalf("GoroutineCount = %d, want 3 daemons and the sweeper", n)
+		}
+		a.Stop()
+		waitFor(t, "goroutines to exit", func() bool { return a.GoroutineCount() == 0 })
+	}
+}
+
+func TestAckRange(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 4, CanAck: LessOrEqual[int]()})
+	for id := int64(0); id < 20; id++ {
+		a.Set(id, int(id%2), "v")
+	}
+	// ids 5 to 12 span all segments, and the odd ones are rejected by flag 0.
+	if n := a.AckRange(5, 12, 0); n != 4 {
+		t.Fatalf("AckRange removed %d messages, want the 4 even ids", n)
+	}
+	if n := a.AckRange(5, 12, 1); n != 4 {
+		t.Fatalf("AckRange removed %d messages, want the 4 odd ids", n)
+	}
+	for id := int64(0); id < 20; id++ {
+		if _, ok := a.GetByID(id); ok != (id < 5 || id > 12) {
+			t.Fatalf("message %d pending = %v after AckRange", id, ok)
+		}
+	}
+	if n := a.AckRange(12, 5, 1); n != 0 {
+		t.Fatalf("AckRange of an empty range removed %d messages", n)
+	}
+}
+
+// BenchmarkCanAck sets and acks messages without CanAck and with LessOrEqual, which share the
+// Remove path.
+func BenchmarkCanAck(b *testing.B) {
+	for _, bb := range []struct {
+		name   string
+		canAck CanAck[int64]
+	}{{"nil", nil}, {"less-or-equal", LessOrEqual[int64]()}} {
+		b.Run(bb.name, func(b *testing.B) {
+			a, _ := NewAckManager(&Config[int64, string]{Capacity: 16, CanAck: bb.canAck})
+			b.ReportAllocs()
+			for i := int64(0); b.Loop(); i++ {
+				a.Set(i, 1, "v")
+				a.Ack(i, 1)
+			}
+		})
+	}
+}
+
+func TestGetAllLeased(t *testing.T) {
+	clock := newFakeClock()
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity: 2,
+		Now:      clock.Now,
+		Backoff:  func(int) time.Duration { return 10 * time.Second },
+	})
+	a.Set(1, 0, "v")
+	a.Set(2, 0, "v")
+	clock.Add(time.Second)
+	// the resends lease messages 1 and 2 for 10s.
+	a.SweepOnce(int64(time.Second))
+	a.Set(3, 0, "v")
+	clock.Add(2 * time.Second)
+	a.Set(4, 0, "v")
+
+	sorted := func(msgs []*Msg[int, string]) []int64 {
+		res := ids(msgs)
+		slices.Sort(res)
+		return res
+	}
+	timeout := int64(time.Second)
+	if got := sorted(a.Get(timeout)); !slices.Equal(got, []int64{3}) {
+		t.Fatalf("Get = %v, want the expired unleased message 3", got)
+	}
+	if got := sorted(a.GetAll(timeout, false)); !slices.Equal(got, []int64{3}) {
+		t.Fatalf("GetAll without leased = %v, want like Get", got)
+	}
+	if got := sorted(a.GetAll(timeout, true)); !slices.Equal(got, []int64{1, 2, 3}) {
+		t.Fatalf("GetAll with leased = %v, want 1, 2 and 3", got)
+	}
+	clock.Add(10 * time.Second)
+	if got := sorted(a.Get(timeout)); !slices.Equal(got, []int64{1, 2, 3, 4}) {
+		t.Fatalf("Get after the lease = %v, want all messages", got)
+	}
+}
+
+func TestDrainPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy  DrainPolicy
+		err     error
+		drained int
+	}{{DrainReject, ErrDraining, 2}, {DrainBuffer, nil, 3}} {
+		var a *AckManager[int, string]
+		var err error
+		called := false
+		a, _ = NewAckManager(&Config[int, string]{
+			Capacity:      2,
+			Async:         true,
+			SetBufferSize: 8,
+			AckBufferSize: 8,
+			DrainPolicy:   tt.policy,
+			OnSet: func(m *Msg[int, string]) {
+				// a Set racing with the drain.
+				if !called {
+					called = true
+					err = a.Set(99, 0, "v")
+				}
+			},
+		})
+		a.Set(1, 0, "v")
+		a.Set(2, 0, "v")
+		if rest, derr := a.StopAndDrain(context.Background()); derr != nil || len(rest) != 0 {
+			t.Fatalf("policy %d: StopAndDrain = %v, %v", tt.policy, rest, derr)
+		}
+		if err != tt.err {
+			t.Fatalf("policy %d: Set during the drain = %v, want %v", tt.policy, err, tt.err)
+		}
+		if a.Len() != tt.drained {
+			t.Fatalf("policy %d: Len = %d after the drain, want %d", tt.policy, a.Len(), tt.drained)
+		}
+		if err := a.Set(3, 0, "v"); err != nil {
+			t.Fatalf("policy %d: Set after the drain = %v", tt.policy, err)
+		}
+	}
+}
+
+func TestGetWhereNTenants(t *testing.T) {
+	clock := newFakeClock()
+	// the flag is the tenant.
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 4, Now: clock.Now})
+	for id := int64(0); id < 30; id++ {
+		a.Set(id, int(id%3), "v")
+	}
+	clock.Add(time.Second)
+	now := clock.Now().UnixNano()
+	expired := func(tenant int) func(*Msg[int, string]) bool {
+		return func(m *Msg[int, string]) bool { return m.Flag == tenant && now-m.Timestamp >= int64(time.Second) }
+	}
+	// each tenant drains its expired messages 4 at a time.
+	for tenant := range 3 {
+		n := 0
+		for {
+			got := a.GetWhereN(expired(tenant), 4)
+			if len(got) > 4 {
+				t.Fatalf("tenant %d: GetWhereN returned %d messages, want at most 4", tenant, len(got))
+			}
+			if len(got) == 0 {
+				break
+			}
+			for _, m := range got {
+				if m.Flag != tenant {
+					t.Fatalf("tenant %d: got message %d of tenant %d", tenant, m.ID, m.Flag)
+				}
+				a.Ack(m.ID, tenant)
+			}
+			n += len(got)
+		}
+		if n != 10 {
+			t.Fatalf("tenant %d drained %d messages, want 10", tenant, n)
+		}
+	}
+	if got := a.GetWhereN(expired(0), 0); got != nil {
+		t.Fatalf("GetWhereN with max 0 = %v, want nil", got)
+	}
+}
+
+func TestMaxPending(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2, MaxPending: 2})
+	a.Set(1, 0, "v")
+	a.Set(2, 0, "v")
+	if err := a.TrySet(3, 0, "v"); err != ErrPendingLimit {
+		t.Fatalf("TrySet at the limit = %v, want %v", err, ErrPendingLimit)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := a.SetContext(ctx, 3, 0, "v"); err != context.DeadlineExceeded {
+		t.Fatalf("SetContext at the limit = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	done := make(chan error)
+	go func() { done <- a.Set(3, 0, "v") }()
+	select {
+	case err := <-done:
+		t.Fatalf("Set at the limit returned %v, want it to block", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	a.Ack(1, 0)
+	if err := <-done; err != nil {
+		t.Fatalf("Set unblocked by an ack = %v", err)
+	}
+	if a.Len() != 2 {
+		t.Fatalf("Len = %d, want MaxPending", a.Len())
+	}
+}
+
+// gateTracer holds every Set between the MaxPending check and recording until open is closed.
+type gateTracer struct{ open chan struct{} }
+
+func (t gateTracer) StartSpan(ctx context.Context, _ string, _ int64, _ map[string]string) (context.Context, func()) {
+	<-t.open
+	return ctx, func() {}
+}
+
+func TestMaxPendingConcurrent(t *testing.T) {
+	tracer := gateTracer{open: make(chan struct{})}
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2, MaxPending: 1, Tracer: tracer})
+	errs := make(chan error, 3)
+	for id := range int64(3) {
+		go func() { errs <- a.TrySet(id, 0, "v") }()
+	}
+	for range 2 {
+		select {
+		case err := <-errs:
+			if err != ErrPendingLimit {
+				t.Fatalf("concurrent TrySet = %v, want %v", err, ErrPendingLimit)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("concurrent TrySets past MaxPending were not rejected")
+		}
+	}
+	close(tracer.open)
+	if err := <-errs; err != nil {
+		t.Fatalf("TrySet holding the slot = %v", err)
+	}
+	if a.Len() != 1 {
+		t.Fatalf("Len = %d, want MaxPending", a.Len())
+	}
+
+	// overwriting a pending message gives back the slot it reserved.
+	a, _ = NewAckManager(&Config[int, string]{Capacity: 2, MaxPending: 2})
+	a.Set(1, 0, "v")
+	a.Set(1, 0, "v2")
+	if err := a.TrySet(2, 0, "v"); err != nil {
+		t.Fatalf("TrySet after overwrite = %v", err)
+	}
+	if err := a.TrySet(3, 0, "v"); err != ErrPendingLimit {
+		t.Fatalf("TrySet at the limit = %v, want %v", err, ErrPendingLimit)
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAsyncKeepsEnqueueTime(t *testing.T) {
+	clock := newFakeClock()
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:      2,
+		Async:         true,
+		SetBufferSize: 8,
+		AckBufferSize: 8,
+		Now:           clock.Now,
+	})
+	start := clock.Now()
+	a.Set(1, 0, "v")
+	clock.Add(time.Second)
+	a.Set(2, 0, "v")
+	clock.Add(time.Second)
+	a.SetBatch([]Entry[int, string]{{ID: 3}, {ID: 4, Timestamp: start.Add(-time.Second)}})
+	clock.Add(time.Minute)
+	a.DrainSetCh()
+	for id, want := range map[int64]time.Time{
+		1: start,
+		2: start.Add(time.Second),
+		3: start.Add(2 * time.Second),
+		4: start.Add(-time.Second),
+	} {
+		m, ok := a.GetByID(id)
+		if !ok {
+			t.Fatalf("message %d not recorded", id)
+		}
+		if m.Timestamp != want.UnixNano() {
+			t.Fatalf("message %d set at %v, want %v", id, time.Unix(0, m.Timestamp), want)
+		}
+	}
+}
+
+func TestAckTimed(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2})
+	start := time.Now()
+	a.Set(1, 0, "v")
+	time.Sleep(20 * time.Millisecond)
+	d, ok := a.AckTimed(1, 0)
+	if elapsed := time.Since(start); !ok || d < 20*time.Millisecond || d > elapsed {
+		t.Fatalf("AckTimed = %v, %v after sleeping 20ms, want between 20ms and %v", d, ok, elapsed)
+	}
+	if d, ok := a.AckTimed(1, 0); ok || d != 0 {
+		t.Fatalf("AckTimed of an absent id = %v, %v, want 0, false", d, ok)
+	}
+
+	clock := newFakeClock()
+	a, _ = NewAckManager(&Config[int, string]{Capacity: 2, Now: clock.Now})
+	a.Set(1, 0, "v")
+	clock.Add(1500 * time.Millisecond)
+	if d, ok := a.AckTimed(1, 0); !ok || d != 1500*time.Millisecond {
+		t.Fatalf("AckTimed = %v, %v with a fake clock, want 1.5s", d, ok)
+	}
+}
+
+func TestHasExpired(t *testing.T) {
+	clock := newFakeClock()
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 4, Now: clock.Now})
+	timeout := int64(time.Minute)
+	if a.HasExpired(timeout) {
+		t.Fatal("HasExpired = true without messages")
+	}
+	// a stale message in segment 3 among fresh ones in the others.
+	a.Set(3, 0, "v")
+	clock.Add(time.Minute)
+	for _, id := range []int64{0, 1, 2, 4, 5} {
+		a.Set(id, 0, "v")
+	}
+	if !a.HasExpired(timeout) {
+		t.Fatal("HasExpired = false with a stale message")
+	}
+	if a.HasExpired(timeout+1) || a.HasExpired(0) {
+		t.Fatal("HasExpired = true with fresh messages only")
+	}
+	a.Ack(3, 0)
+	if a.HasExpired(timeout) {
+		t.Fatal("HasExpired = true after the stale message is acked")
+	}
+}
+
+func TestToMapFromMap(t *testing.T) {
+	clock := newFakeClock()
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2, Now: clock.Now})
+	a.Set(1, 10, "a")
+	clock.Add(time.Second)
+	a.Set(2, 20, "b")
+	b, _ := NewAckManager(&Config[int, string]{Capacity: 3})
+	b.FromMap(a.ToMap())
+	if err := b.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range a.ToMap() {
+		m, ok := b.GetByID(id)
+		if !ok || m.Flag != want.Flag || m.Value != want.Value || m.Timestamp != want.Timestamp {
+			t.Fatalf("msg %d from the map = %v, %v, want %v", id, m, ok, want)
+		}
+	}
+	if b.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", b.Len())
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2})
+	a.Set(1, 0, "v")
+	a.Set(2, 0, "v")
+	ch := a.Empty()
+	a.Ack(1, 0)
+	select {
+	case <-ch:
+		t.Fatal("Empty closed with a message still pending")
+	default:
+	}
+	go a.Ack(2, 0)
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("Empty not closed after the last message is acked")
+	}
+	select {
+	case <-a.Empty():
+		t.Fatal("Empty of the next transition is already closed")
+	default:
+	}
+	if err := a.WaitEmpty(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetGrouped(t *testing.T) {
+	clock := newFakeClock()
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 3, Now: clock.Now})
+	for id := range int64(6) {
+		a.Set(id, 0, "v")
+	}
+	clock.Add(time.Minute)
+	a.Set(6, 0, "fresh")
+	groups := a.GetGrouped(int64(time.Second))
+	if len(groups) != 3 {
+		t.Fatalf("%d groups, want one per segment", len(groups))
+	}
+	for i, g := range groups {
+		got := ids(g)
+		slices.Sort(got)
+		if want := []int64{int64(i), int64(i) + 3}; !slices.Equal(got, want) {
+			t.Fatalf("group %d = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestCloneValue(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, []int]{Capacity: 2, CloneValue: slices.Clone[[]int]})
+	v := []int{1, 2}
+	a.Set(1, 0, v)
+	v[0] = 9
+	if got, _ := a.Value(1); !slices.Equal(got, []int{1, 2}) {
+		t.Fatalf("Value after the caller changed its slice = %v, want [1 2]", got)
+	}
+}
+
+func TestAckErrorBufferSize(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2, Async: true, SetBufferSize: 1, AckBufferSize: 2})
+	a.TrySet(1, 0, "v")
+	var ackErr *AckError
+	err := a.TrySet(2, 0, "v")
+	if !errors.Is(err, ErrMsgRecordFailed) || !errors.As(err, &ackErr) || ackErr.Len != 1 || ackErr.Cap != 1 {
+		t.Fatalf("TrySet on a full buffer = %v, want ErrMsgRecordFailed with buffer 1/1", err)
+	}
+	a.TryAck(1, 0)
+	a.TryAck(2, 0)
+	err = a.TryAck(3, 0)
+	if !errors.Is(err, ErrMsgAckFailed) || !errors.As(err, &ackErr) || ackErr.Len != 2 || ackErr.Cap != 2 {
+		t.Fatalf("TryAck on a full buffer = %v, want ErrMsgAckFailed with buffer 2/2", err)
+	}
+}
@@ -0,0 +1,123 @@
+// Package acktest provides utilities for testing code using ack managers.
+package acktest
+
+import (
+	"slices"
+	"sync"
+	"testing"
+
+	"ack"
+)
+
+// TestDoubleChecker wraps an ack manager and remembers the ids successfully set and acked
+// through it, so that a test can check at the end that no message is lost or kept by mistake,
+// e.g. by buffer overflow. It assumes every ack is allowed by CanAck.
+//
+// Only Set, TrySet, SetBatch, Ack and TryAck are tracked. The other methods of the embedded ack
+// manager that record or remove messages, like SetWithMeta, AckRange, CompareAndAck, ExtractWhere
+// or DrainTo, bypass the checker, so Verify reports the messages they change unless the test
+// avoids them.
+type TestDoubleChecker[flag, val any] struct {
+	*ack.AckManager[flag, val]
+
+	mu      sync.Mutex
+	pending map[int64]struct{}
+}
+
+// NewTestDoubleChecker wraps am.
+func NewTestDoubleChecker[flag, val any](am *ack.AckManager[flag, val]) *TestDoubleChecker[flag, val] {
+	return &TestDoubleChecker[flag, val]{
+		AckManager: am,
+		pending:    map[int64]struct{}{},
+	}
+}
+
+// Set sets the message by the ack manager and remembers its id if it succeeds.
+func (c *TestDoubleChecker[flag, val]) Set(id int64, f flag, v val) error {
+	err := c.AckManager.Set(id, f, v)
+	if err == nil {
+		c.track(id)
+	}
+	return err
+}
+
+// TrySet is like Set but calls TrySet of the ack manager.
+func (c *TestDoubleChecker[flag, val]) TrySet(id int64, f flag, v val) error {
+	err := c.AckManager.TrySet(id, f, v)
+	if err == nil {
+		c.track(id)
+	}
+	return err
+}
+
+// SetBatch sets the messages by the ack manager and remembers the ids of the ones recorded.
+func (c *TestDoubleChecker[flag, val]) SetBatch(batch []ack.Entry[flag, val]) (int, error) {
+	n, err := c.AckManager.SetBatch(batch)
+	for _, e := range batch[:n] {
+		c.track(e.ID)
+	}
+	return n, err
+}
+
+// Ack acks the message by the ack manager and forgets its id if it succeeds.
+func (c *TestDoubleChecker[flag, val]) Ack(id int64, f flag) error {
+	err := c.AckManager.Ack(id, f)
+	if err == nil {
+		c.forget(id)
+	}
+	return err
+}
+
+// TryAck is like Ack but calls TryAck of the ack manager.
+func (c *TestDoubleChecker[flag, val]) TryAck(id int64, f flag) error {
+	err := c.AckManager.TryAck(id, f)
+	if err == nil {
+		c.forget(id)
+	}
+	return err
+}
+
+// track remembers id as pending. Ids are remembered by their canonical ids, which ToMap is keyed
+// by.
+func (c *TestDoubleChecker[flag, val]) track(id int64) {
+	c.mu.Lock()
+	c.pending[c.CanonicalID(id)] = struct{}{}
+	c.mu.Unlock()
+}
+
+// forget forgets id.
+func (c *TestDoubleChecker[flag, val]) forget(id int64) {
+	c.mu.Lock()
+	delete(c.pending, c.CanonicalID(id))
+	c.mu.Unlock()
+}
+
+// Verify fails t if the pending messages of the ack manager are not exactly the ones set and not
+// acked through c. In async mode it must be called after the buffers are drained, e.g. by
+// StopAndDrain.
+func (c *TestDoubleChecker[flag, val]) Verify(t testing.TB) {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	actual := c.ToMap()
+	var lost, extra []int64
+	for id := range c.pending {
+		if _, ok := actual[id]; !ok {
+			lost = append(lost, id)
+		}
+	}
+	for id := range actual {
+		if _, ok := c.pending[id]; !ok {
+			extra = append(extra, id)
+		}
+	}
+	if len(lost) > 0 {
+		slices.Sort(lost)
+		t.Errorf("acktest: messages set but not pending: %v", lost)
+	}
+	if len(extra) > 0 {
+		slices.Sort(extra)
+		t.Errorf("acktest: messages pending but not set or already acked: %v", extra)
+	}
+}
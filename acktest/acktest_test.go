@@ -0,0 +1,93 @@
+package acktest
+
+import (
+	"fmt"
+	"testing"
+
+	"ack"
+)
+
+// recordingTB records the errors reported by Verify instead of failing the test.
+type recordingTB struct {
+	testing.TB
+	errs []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+func newChecker(t *testing.T, cfg *ack.Config[int, string]) *TestDoubleChecker[int, string] {
+	t.Helper()
+	if cfg == nil {
+		cfg = &ack.Config[int, string]{}
+	}
+	cfg.Capacity = 4
+	am, err := ack.NewAckManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewTestDoubleChecker(am)
+}
+
+func verify(c *TestDoubleChecker[int, string]) []string {
+	tb := &recordingTB{}
+	c.Verify(tb)
+	return tb.errs
+}
+
+func TestVerify(t *testing.T) {
+	c := newChecker(t, nil)
+	for id := int64(1); id <= 3; id++ {
+		if err := c.Set(id, 0, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.SetBatch([]ack.Entry[int, string]{{ID: 4}, {ID: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.TrySet(6, 0, "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ack(1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.TryAck(4, 0); err != nil {
+		t.Fatal(err)
+	}
+	if errs := verify(c); len(errs) != 0 {
+		t.Fatalf("Verify reported %v, want nothing", errs)
+	}
+}
+
+func TestVerifyReportsLostAndExtra(t *testing.T) {
+	c := newChecker(t, nil)
+	c.Set(1, 0, "v")
+	c.Set(2, 0, "v")
+	// bypass the checker on purpose.
+	c.AckManager.Ack(1, 0)
+	c.AckManager.Set(3, 0, "v")
+
+	errs := verify(c)
+	want := []string{
+		"acktest: messages set but not pending: [1]",
+		"acktest: messages pending but not set or already acked: [3]",
+	}
+	if fmt.Sprint(errs) != fmt.Sprint(want) {
+		t.Fatalf("Verify reported %q, want %q", errs, want)
+	}
+}
+
+func TestVerifyCanonicalID(t *testing.T) {
+	c := newChecker(t, &ack.Config[int, string]{
+		CanonicalID: func(id int64) int64 { return id % 100 },
+	})
+	c.Set(101, 0, "v")
+	c.Set(2, 0, "v")
+	c.Ack(102, 0)
+	if errs := verify(c); len(errs) != 0 {
+		t.Fatalf("Verify reported %v, want nothing", errs)
+	}
+}
@@ -0,0 +1,22 @@
+package ack
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// ExponentialBackoff returns a Backoff doubling from base with each retry up to max, with a
+// random jitter of up to half of the delay so that resends of many messages are spread out.
+func ExponentialBackoff(base, max time.Duration) func(retries int) time.Duration {
+	return func(retries int) time.Duration {
+		d := base
+		for i := 1; i < retries && d < max; i++ {
+			d <<= 1
+		}
+		d = min(d, max)
+		if d <= 1 {
+			return d
+		}
+		return d/2 + rand.N(d/2+1)
+	}
+}
@@ -0,0 +1,52 @@
+package ack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(100*time.Millisecond, time.Second)
+	for retries, d := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		5: time.Second,
+		9: time.Second,
+	} {
+		for range 100 {
+			if got := backoff(retries); got < d/2 || got > d {
+				t.Fatalf("backoff(%d) = %v, want within [%v, %v]", retries, got, d/2, d)
+			}
+		}
+	}
+}
+
+func TestBackoffGapsGrow(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	var resent []time.Duration
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity: 2,
+		Now:      clock.Now,
+		Backoff:  func(retries int) time.Duration { return time.Duration(retries) * 2 * time.Second },
+		Resend: func(m *Msg[int, string]) error {
+			resent = append(resent, clock.Now().Sub(start))
+			return nil
+		},
+	})
+	a.Set(1, 0, "v")
+	for range 30 {
+		clock.Add(time.Second)
+		a.SweepOnce(int64(time.Second))
+	}
+	if len(resent) < 4 {
+		t.Fatalf("resent at %v, want at least 4 resends", resent)
+	}
+	for i := 2; i < len(resent); i++ {
+		if prev, gap := resent[i-1]-resent[i-2], resent[i]-resent[i-1]; gap <= prev {
+			t.Fatalf("resent at %v, gap %v after a gap of %v, want growing gaps", resent, gap, prev)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package ack
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+)
+
+// binaryVersion is the version of the binary encoding of Msg, the first byte of the encoding.
+const binaryVersion = 1
+
+// MarshalBinary encodes the message compactly, e.g. to send it to another process. The flag and
+// the value must be string, []byte, int, int64 or implement encoding.BinaryMarshaler, otherwise
+// it fails with ErrEncoding. Parts, Meta, NotBefore and Pinned are not encoded.
+func (m *Msg[flag, val]) MarshalBinary() ([]byte, error) {
+	b := []byte{binaryVersion}
+	b = binary.AppendVarint(b, m.ID)
+	b = binary.AppendVarint(b, m.Timestamp)
+	b = binary.AppendVarint(b, m.Created)
+	b = binary.AppendUvarint(b, uint64(m.Retries))
+	var err error
+	if b, err = appendField(b, m.Flag); err != nil {
+		return nil, err
+	}
+	return appendField(b, m.Value)
+}
+
+// UnmarshalBinary decodes the message encoded by MarshalBinary. The flag and the value must be
+// string, []byte, int, int64 or implement encoding.BinaryUnmarshaler by pointer.
+func (m *Msg[flag, val]) UnmarshalBinary(b []byte) error {
+	if len(b) == 0 || b[0] != binaryVersion {
+		return fmt.Errorf("%w: unknown version", ErrEncoding)
+	}
+	b = b[1:]
+	var ok bool
+	if m.ID, b, ok = readVarint(b); !ok {
+		return fmt.Errorf("%w: bad id", ErrEncoding)
+	}
+	if m.Timestamp, b, ok = readVarint(b); !ok {
+		return fmt.Errorf("%w: bad timestamp", ErrEncoding)
+	}
+	if m.Created, b, ok = readVarint(b); !ok {
+		return fmt.Errorf("%w: bad created time", ErrEncoding)
+	}
+	retries, n := binary.Uvarint(b)
+	if n <= 0 {
+		return fmt.Errorf("%w: bad retries", ErrEncoding)
+	}
+	m.Retries, b = int(retries), b[n:]
+	var err error
+	if b, err = readField(b, &m.Flag); err != nil {
+		return err
+	}
+	_, err = readField(b, &m.Value)
+	return err
+}
+
+// appendField appends the length-prefixed encoding of x to b.
+func appendField(b []byte, x any) ([]byte, error) {
+	var data []byte
+	switch x := x.(type) {
+	case encoding.BinaryMarshaler:
+		var err error
+		if data, err = x.MarshalBinary(); err != nil {
+			return nil, err
+		}
+	case string:
+		data = []byte(x)
+	case []byte:
+		data = x
+	case int:
+		data = binary.AppendVarint(nil, int64(x))
+	case int64:
+		data = binary.AppendVarint(nil, x)
+	default:
+		return nil, fmt.Errorf("%w: unsupported type %T", ErrEncoding, x)
+	}
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...), nil
+}
+
+// readField decodes the length-prefixed field at the beginning of b into x, and returns the rest.
+func readField(b []byte, x any) ([]byte, error) {
+	size, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < size {
+		return nil, fmt.Errorf("%w: truncated field", ErrEncoding)
+	}
+	data, rest := b[n:n+int(size)], b[n+int(size):]
+	switch x := x.(type) {
+	case encoding.BinaryUnmarshaler:
+		return rest, x.UnmarshalBinary(data)
+	case *string:
+		*x = string(data)
+	case *[]byte:
+		*x = append([]byte(nil), data...)
+	case *int:
+		v, _, ok := readVarint(data)
+		if !ok {
+			return nil, fmt.Errorf("%w: bad int", ErrEncoding)
+		}
+		*x = int(v)
+	case *int64:
+		v, _, ok := readVarint(data)
+		if !ok {
+			return nil, fmt.Errorf("%w: bad int", ErrEncoding)
+		}
+		*x = v
+	default:
+		return nil, fmt.Errorf("%w: unsupported type %T", ErrEncoding, x)
+	}
+	return rest, nil
+}
+
+// readVarint decodes the varint at the beginning of b, and returns the rest.
+func readVarint(b []byte) (int64, []byte, bool) {
+	v, n := binary.Varint(b)
+	if n <= 0 {
+		return 0, nil, false
+	}
+	return v, b[n:], true
+}
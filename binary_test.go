@@ -0,0 +1,58 @@
+package ack
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	m := &Msg[int64, string]{ID: -7, Timestamp: 1e18, Created: 1e18 - 5, Retries: 3, Flag: 42, Value: "héllo"}
+	b, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != binaryVersion {
+		t.Fatalf("first byte = %d, want the version %d", b[0], binaryVersion)
+	}
+	var got Msg[int64, string]
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != m.ID || got.Timestamp != m.Timestamp || got.Created != m.Created || got.Retries != m.Retries ||
+		got.Flag != m.Flag || got.Value != m.Value {
+		t.Fatalf("decoded %+v, want %+v", got, *m)
+	}
+
+	// other supported types, including an encoding.BinaryMarshaler.
+	ts := time.Unix(1_000_000, 5).UTC()
+	m2 := &Msg[time.Time, []byte]{ID: 1, Flag: ts, Value: []byte{0, 1, 2}}
+	if b, err = m2.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+	var got2 Msg[time.Time, []byte]
+	if err := got2.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !got2.Flag.Equal(ts) || !bytes.Equal(got2.Value, m2.Value) {
+		t.Fatalf("decoded %+v, want %+v", got2, *m2)
+	}
+}
+
+func TestBinaryErrors(t *testing.T) {
+	if _, err := (&Msg[float64, string]{}).MarshalBinary(); !errors.Is(err, ErrEncoding) {
+		t.Fatalf("MarshalBinary of an unsupported flag = %v, want %v", err, ErrEncoding)
+	}
+	b, _ := (&Msg[int, string]{ID: 1, Flag: 2, Value: "value"}).MarshalBinary()
+	var m Msg[int, string]
+	for _, bad := range [][]byte{
+		nil,
+		append([]byte{binaryVersion + 1}, b[1:]...),
+		b[:len(b)-1],
+	} {
+		if err := m.UnmarshalBinary(bad); !errors.Is(err, ErrEncoding) {
+			t.Fatalf("UnmarshalBinary(%v) = %v, want %v", bad, err, ErrEncoding)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package ack
+
+import (
+	"maps"
+	"slices"
+	"sync/atomic"
+)
+
+// defaultMaxTombstones is MaxTombstones when it is not set.
+const defaultMaxTombstones = 100000
+
+// changed stamps m, which is about to be recorded, with a new version if TrackChanges is set. It
+// must be called with the write lock held.
+func (r *recorder[flag, val]) changed(m *Msg[flag, val]) {
+	if r.am.trackChanges {
+		m.version = atomic.AddUint64(&r.am.version, 1)
+		delete(r.tombstones, m.ID)
+	}
+}
+
+// deleted records a tombstone of id if TrackChanges is set. It must be called with the write
+// lock held.
+func (r *recorder[flag, val]) deleted(id int64) {
+	if r.am.trackChanges {
+		r.tombstones[id] = atomic.AddUint64(&r.am.version, 1)
+		if len(r.tombstones) > r.am.maxTombstones/len(r.am.records)+1 {
+			r.dropTombstones()
+		}
+	}
+}
+
+// dropTombstones drops the older half of the tombstones, and raises tombstoneFloor to the last
+// dropped version. It must be called with the write lock held.
+func (r *recorder[flag, val]) dropTombstones() {
+	versions := slices.Sorted(maps.Values(r.tombstones))
+	last := versions[len(versions)/2]
+	for id, v := range r.tombstones {
+		if v <= last {
+			delete(r.tombstones, id)
+		}
+	}
+	for {
+		floor := atomic.LoadUint64(&r.am.tombstoneFloor)
+		if last <= floor || atomic.CompareAndSwapUint64(&r.am.tombstoneFloor, floor, last) {
+			return
+		}
+	}
+}
+
+// SnapshotSince returns the pending messages recorded or changed since version, the ids of the
+// messages removed since version, and the version to pass to the next call. Version 0 gets all
+// pending messages. It requires TrackChanges, otherwise it returns nothing.
+//
+// Applying the results of successive calls in order, upserting the messages and deleting the
+// removed ids, keeps a copy like a write-ahead log in sync with the ack manager. Changes racing
+// with the call may be returned again by the next call. It assumes a single consumer: the
+// tombstones of removals before version are dropped.
+//
+// full reports that msgs are all pending messages and the copy must be replaced by them instead,
+// which is the case for version 0 and when tombstones since version are dropped beyond
+// MaxTombstones.
+func (a *AckManager[flag, val]) SnapshotSince(version uint64) (msgs []*Msg[flag, val], removed []int64, next uint64,
+	full bool) {
+	if !a.trackChanges {
+		return nil, nil, version, false
+	}
+	if version < atomic.LoadUint64(&a.tombstoneFloor) {
+		version = 0
+	}
+	full = version == 0
+	next = atomic.LoadUint64(&a.version)
+	for _, r := range a.records {
+		r.lock()
+		for _, m := range r.msgs {
+			if m.version > version {
+				msgs = append(msgs, m)
+			}
+		}
+		for id, v := range r.tombstones {
+			if v > version {
+				removed = append(removed, id)
+			} else {
+				delete(r.tombstones, id)
+			}
+		}
+		r.Unlock()
+	}
+	if !full && version < atomic.LoadUint64(&a.tombstoneFloor) {
+		// tombstones since version were dropped during the scan.
+		return a.SnapshotSince(0)
+	}
+	return msgs, removed, next, full
+}
@@ -0,0 +1,86 @@
+package ack
+
+import (
+	"maps"
+	"testing"
+)
+
+// replica is a copy of the pending messages kept in sync by SnapshotSince.
+type replica map[int64]int
+
+func (c replica) sync(t *testing.T, am *AckManager[int64, int], version uint64) uint64 {
+	t.Helper()
+	msgs, removed, next, full := am.SnapshotSince(version)
+	if full {
+		clear(c)
+	}
+	for _, id := range removed {
+		delete(c, id)
+	}
+	for _, m := range msgs {
+		c[m.ID] = m.Value
+	}
+	return next
+}
+
+// pending returns the pending values of am by id, as a full snapshot.
+func pending(am *AckManager[int64, int]) replica {
+	res := replica{}
+	for id, m := range am.ToMap() {
+		res[id] = m.Value
+	}
+	return res
+}
+
+func TestSnapshotSinceMatchesFullSnapshot(t *testing.T) {
+	am, err := NewAckManager(&Config[int64, int]{Capacity: 4, TrackChanges: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := replica{}
+	var version uint64
+	for round := 0; round < 5; round++ {
+		for i := int64(0); i < 20; i++ {
+			switch (i + int64(round)) % 3 {
+			case 0:
+				am.Set(i, 0, round)
+			case 1:
+				am.Ack(i, 0)
+			}
+		}
+		version = c.sync(t, am, version)
+		if want := pending(am); !maps.Equal(c, want) {
+			t.Fatalf("round %d: replica = %v, want %v", round, c, want)
+		}
+	}
+	msgs, removed, _, full := am.SnapshotSince(version)
+	if len(msgs) != 0 || len(removed) != 0 || full {
+		t.Fatalf("SnapshotSince(next) = %d msgs, %d removed, full %v, want nothing", len(msgs), len(removed), full)
+	}
+}
+
+func TestSnapshotSinceAfterTombstonesDropped(t *testing.T) {
+	am, err := NewAckManager(&Config[int64, int]{Capacity: 1, TrackChanges: true, MaxTombstones: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := replica{}
+	for i := int64(0); i < 30; i++ {
+		am.Set(i, 0, 0)
+	}
+	version := c.sync(t, am, 0)
+	for i := int64(0); i < 25; i++ {
+		am.Ack(i, 0)
+	}
+	if n := len(am.records[0].tombstones); n > 11 {
+		t.Fatalf("%d tombstones kept, want at most 11", n)
+	}
+	_, _, _, full := am.SnapshotSince(version)
+	if !full {
+		t.Fatal("SnapshotSince from before dropped tombstones is not full")
+	}
+	c.sync(t, am, version)
+	if want := pending(am); !maps.Equal(c, want) {
+		t.Fatalf("replica = %v, want %v", c, want)
+	}
+}
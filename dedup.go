@@ -0,0 +1,54 @@
+package ack
+
+import (
+	"container/list"
+	"sync"
+)
+
+// recentAcks is an LRU set of recently acked ids.
+type recentAcks struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List // of int64, most recent first
+	ids   map[int64]*list.Element
+}
+
+func newRecentAcks(size int) *recentAcks {
+	return &recentAcks{
+		size:  size,
+		order: list.New(),
+		ids:   make(map[int64]*list.Element, size),
+	}
+}
+
+// Add adds id as the most recent one, evicting the least recent id if it is full.
+func (r *recentAcks) Add(id int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.ids[id]; ok {
+		r.order.MoveToFront(e)
+		return
+	}
+	r.ids[id] = r.order.PushFront(id)
+	if r.order.Len() > r.size {
+		delete(r.ids, r.order.Remove(r.order.Back()).(int64))
+	}
+}
+
+// Contains reports whether id is recently acked.
+func (r *recentAcks) Contains(id int64) bool {
+	r.mu.Lock()
+	_, ok := r.ids[id]
+	r.mu.Unlock()
+	return ok
+}
+
+// Remove forgets id, e.g. when it's set again.
+func (r *recentAcks) Remove(id int64) {
+	r.mu.Lock()
+	if e, ok := r.ids[id]; ok {
+		r.order.Remove(e)
+		delete(r.ids, id)
+	}
+	r.mu.Unlock()
+}
@@ -0,0 +1,37 @@
+package ack
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRecentAcks(t *testing.T) {
+	var dups []int64
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:       2,
+		RecentAcks:     2,
+		OnDuplicateAck: func(id int64, f int) { dups = append(dups, id) },
+	})
+	for id := int64(1); id <= 3; id++ {
+		a.Set(id, 0, "v")
+	}
+	a.Ack(1, 0)
+	a.Ack(1, 0)
+	if !slices.Equal(dups, []int64{1}) || a.Stats().DuplicateAcks != 1 {
+		t.Fatalf("duplicates %v, want the second ack of 1", dups)
+	}
+	// acks of 2 and 3 push 1 out of the window.
+	a.Ack(2, 0)
+	a.Ack(3, 0)
+	a.Ack(1, 0)
+	a.Ack(3, 0)
+	if !slices.Equal(dups, []int64{1, 3}) {
+		t.Fatalf("duplicates %v, want 1 and 3 but not 1 out of the window", dups)
+	}
+	// setting an id again forgets it.
+	a.Set(3, 0, "v")
+	a.Ack(3, 0)
+	if len(dups) != 2 || a.Len() != 0 {
+		t.Fatalf("duplicates %v with Len %d, want the ack of 3 set again to remove it", dups, a.Len())
+	}
+}
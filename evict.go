@@ -0,0 +1,88 @@
+package ack
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// evict removes the oldest messages until there are no more than maxTotal pending messages, or
+// only pinned ones are left. Finding the globally oldest message needs a scan of all segments,
+// so it is approximated by the oldest one among evictSamples random segments. All segments are
+// scanned only when the sampled ones are empty.
+func (a *AckManager[flag, val]) evict() {
+	for atomic.LoadInt64(&a.pending) > int64(a.maxTotal) {
+		var r *recorder[flag, val]
+		var m *Msg[flag, val]
+		for i := 0; i < a.evictSamples; i++ {
+			sr := a.records[rand.IntN(len(a.records))]
+			if sm := sr.Evictable(); sm != nil && (m == nil || sm.Timestamp < m.Timestamp) {
+				r, m = sr, sm
+			}
+		}
+		if m == nil {
+			for _, sr := range a.records {
+				if sm := sr.Evictable(); sm != nil && (m == nil || sm.Timestamp < m.Timestamp) {
+					r, m = sr, sm
+				}
+			}
+		}
+		if m == nil {
+			return
+		}
+		if !r.Evict(m, true) {
+			continue
+		}
+		a.logger.Warn("msg evicted, too many pending msgs", "id", m.ID)
+		if a.onEvict != nil {
+			a.onEvict(m)
+		}
+		a.removed(RemoveEvicted, m)
+	}
+}
+
+// Evictable returns the oldest message not pinned, or nil if there is none. The messages are
+// scanned when the oldest one is pinned.
+func (r *recorder[flag, val]) Evictable() *Msg[flag, val] {
+	if o := r.Oldest(); o == nil || !o.Pinned {
+		return o
+	}
+	r.rlock()
+	defer r.RUnlock()
+	var oldest *Msg[flag, val]
+	for _, m := range r.msgs {
+		if !m.Pinned && (oldest == nil || m.Timestamp < oldest.Timestamp) {
+			oldest = m
+		}
+	}
+	return oldest
+}
+
+// Pin protects the pending message of id from eviction by MaxTotal, e.g. for critical messages
+// that must not be dropped under memory pressure. It can still be acked, resent and dead-lettered
+// as usual. It reports whether the message is pending.
+func (a *AckManager[flag, val]) Pin(id int64) bool {
+	id = a.canonical(id)
+	return a.segment(id).pin(id, true)
+}
+
+// Unpin makes the pending message of id evictable again. It reports whether the message is
+// pending.
+func (a *AckManager[flag, val]) Unpin(id int64) bool {
+	id = a.canonical(id)
+	return a.segment(id).pin(id, false)
+}
+
+// pin sets Pinned of the message of id to pinned, and reports whether the message exists.
+func (r *recorder[flag, val]) pin(id int64, pinned bool) bool {
+	r.lock()
+	defer r.Unlock()
+	m, ok := r.msgs[id]
+	if !ok || m.Pinned == pinned {
+		return ok
+	}
+	c := *m
+	c.Pinned = pinned
+	r.changed(&c)
+	r.msgs[id] = &c
+	return true
+}
@@ -0,0 +1,105 @@
+package ack
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMaxTotalEvictsOldest(t *testing.T) {
+	clock := newFakeClock()
+	var evicted []int64
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity: 1,
+		Now:      clock.Now,
+		MaxTotal: 3,
+		OnEvict:  func(m *Msg[int, string]) { evicted = append(evicted, m.ID) },
+	})
+	for id := int64(1); id <= 3; id++ {
+		a.Set(id, 0, "v")
+		clock.Add(time.Second)
+	}
+	if len(evicted) != 0 {
+		t.Fatalf("evicted %v at MaxTotal, want nothing", evicted)
+	}
+	a.Set(4, 0, "v")
+	clock.Add(time.Second)
+	a.Set(5, 0, "v")
+	if !slices.Equal(evicted, []int64{1, 2}) {
+		t.Fatalf("evicted %v beyond MaxTotal, want the oldest 1 and 2", evicted)
+	}
+	if a.Len() != 3 {
+		t.Fatalf("Len = %d, want MaxTotal", a.Len())
+	}
+	// overwriting a pending message doesn't exceed MaxTotal.
+	a.Set(5, 0, "w")
+	if len(evicted) != 2 {
+		t.Fatalf("evicted %v on overwrite", evicted)
+	}
+}
+
+func TestMaxTotalAcrossSegments(t *testing.T) {
+	evicted := 0
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity: 8,
+		MaxTotal: 10,
+		OnEvict:  func(m *Msg[int, string]) { evicted++ },
+	})
+	for id := int64(0); id < 100; id++ {
+		a.Set(id, 0, "v")
+	}
+	if a.Len() != 10 || evicted != 90 {
+		t.Fatalf("Len = %d with %d evicted, want 10 with 90 evicted", a.Len(), evicted)
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPinnedSurviveEviction(t *testing.T) {
+	clock := newFakeClock()
+	var evicted []int64
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity: 1,
+		Now:      clock.Now,
+		MaxTotal: 3,
+		OnEvict:  func(m *Msg[int, string]) { evicted = append(evicted, m.ID) },
+	})
+	for id := int64(1); id <= 3; id++ {
+		a.Set(id, 0, "v")
+		clock.Add(time.Second)
+	}
+	held := a.Get(1)
+	if !a.Pin(1) || !a.Pin(2) || a.Pin(9) {
+		t.Fatal("Pin didn't report only the pending messages")
+	}
+	a.Set(4, 0, "v")
+	clock.Add(time.Second)
+	a.Set(5, 0, "v")
+	if !slices.Equal(evicted, []int64{3, 4}) {
+		t.Fatalf("evicted %v, want the unpinned 3 and 4", evicted)
+	}
+	for _, m := range held {
+		if m.Pinned {
+			t.Fatal("Pin modified a message held by a caller of Get")
+		}
+	}
+	// when all others are pinned, the new message is evicted.
+	a.Pin(5)
+	a.Set(6, 0, "v")
+	if !slices.Equal(evicted, []int64{3, 4, 6}) || a.Len() != 3 {
+		t.Fatalf("evicted %v with Len %d, want 6 evicted and the 3 pinned kept", evicted, a.Len())
+	}
+
+	// pinned messages can still be acked, and unpinned ones evicted.
+	a.Ack(2, 0)
+	if _, ok := a.GetByID(2); ok {
+		t.Fatal("pinned message not acked")
+	}
+	a.Unpin(1)
+	a.Set(7, 0, "v")
+	a.Set(8, 0, "v")
+	if !slices.Equal(evicted, []int64{3, 4, 6, 1}) {
+		t.Fatalf("evicted %v, want the unpinned 1", evicted)
+	}
+}
@@ -0,0 +1,72 @@
+package ack_test
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"ack"
+)
+
+func ExampleSimpleManager() {
+	am, err := ack.NewSimpleManager(4, false)
+	if err != nil {
+		panic(err)
+	}
+	am.Set(1, 100, "hello")
+	am.Set(2, 100, "world")
+
+	// acks by an older version are ignored.
+	am.Ack(1, 99)
+	am.Ack(2, 100)
+
+	v, ok := am.Value(1)
+	fmt.Println(am.Len(), v, ok)
+	// Output: 1 hello true
+}
+
+func ExampleAckManager_GetWhere() {
+	am, err := ack.NewAckManager(&ack.Config[int, string]{Capacity: 4})
+	if err != nil {
+		panic(err)
+	}
+	am.Set(1, 0, "order")
+	am.Set(2, 0, "refund")
+	am.Set(3, 0, "order")
+
+	orders := am.GetWhere(func(m *ack.Msg[int, string]) bool { return m.Value == "order" })
+	slices.SortFunc(orders, func(a, b *ack.Msg[int, string]) int { return cmp.Compare(a.ID, b.ID) })
+	for _, m := range orders {
+		fmt.Println(m.ID, m.Value)
+	}
+	// Output:
+	// 1 order
+	// 3 order
+}
+
+func ExampleAckManager_SweepOnce() {
+	am, err := ack.NewAckManager(&ack.Config[int, string]{
+		Capacity:   4,
+		MaxRetries: 1,
+		Resend: func(m *ack.Msg[int, string]) error {
+			fmt.Println("resend", m.ID, m.Value, m.Retries)
+			return nil
+		},
+		OnDeadLetter: func(m *ack.Msg[int, string]) {
+			fmt.Println("dead letter", m.ID, m.Value)
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	am.Set(1, 0, "hello")
+
+	// a timeout of 0 treats every pending message as not acked in time.
+	am.SweepOnce(0)
+	am.SweepOnce(0)
+	fmt.Println(am.Len())
+	// Output:
+	// resend 1 hello 1
+	// dead letter 1 hello
+	// 0
+}
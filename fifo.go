@@ -0,0 +1,56 @@
+package ack
+
+import (
+	"iter"
+	"slices"
+)
+
+// fifoCompactSlack is how many stale entries the FIFO queue of a segment may hold beyond twice
+// the number of its messages before it's rebuilt.
+const fifoCompactSlack = 64
+
+// push appends m to the FIFO queue in FIFO mode. It must be called with the write lock held.
+func (r *recorder[flag, val]) push(m *Msg[flag, val]) {
+	if r.am.fifo {
+		r.fifo = append(r.fifo, m)
+	}
+}
+
+// live returns the recorded message e refers to, and false if e is stale because the message is
+// removed, set again or refreshed since e was pushed.
+func (r *recorder[flag, val]) live(e *Msg[flag, val]) (*Msg[flag, val], bool) {
+	m, ok := r.msgs[e.ID]
+	return m, ok && m.serial == e.serial && m.Timestamp == e.Timestamp
+}
+
+// rebuildFIFO rebuilds the FIFO queue from the recorded messages in timestamp order, dropping
+// stale entries. It must be called with the write lock held.
+func (r *recorder[flag, val]) rebuildFIFO() {
+	r.fifo = r.fifo[:0]
+	for _, m := range r.msgs {
+		r.fifo = append(r.fifo, m)
+	}
+	slices.SortFunc(r.fifo, func(a, b *Msg[flag, val]) int {
+		return int(min(max(a.Timestamp-b.Timestamp, -1), 1))
+	})
+}
+
+// all returns the recorded messages, oldest first in FIFO mode. It must be called with the lock
+// held.
+func (r *recorder[flag, val]) all() iter.Seq[*Msg[flag, val]] {
+	return func(yield func(*Msg[flag, val]) bool) {
+		if !r.am.fifo {
+			for _, m := range r.msgs {
+				if !yield(m) {
+					return
+				}
+			}
+			return
+		}
+		for _, e := range r.fifo {
+			if m, ok := r.live(e); ok && !yield(m) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package ack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFIFOGetStopsAtFirstNotExpired(t *testing.T) {
+	clock := newFakeClock()
+	am, err := NewAckManager(&Config[int64, int]{Capacity: 1, FIFO: true, Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		am.Set(i, 0, int(i))
+		clock.Add(time.Second)
+	}
+	got := am.Get(int64(2 * time.Second))
+	if len(got) != 2 || got[0].ID != 1 || got[1].ID != 2 {
+		t.Fatalf("Get = %v, want ids 1 and 2 in order", ids(got))
+	}
+}
+
+func TestFIFOSetAgainAtSameTimestamp(t *testing.T) {
+	am, err := NewAckManager(&Config[int64, int]{Capacity: 1, FIFO: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now().Add(-time.Minute)
+	am.SetAt(1, 0, 1, ts)
+	am.SetAt(1, 0, 2, ts)
+	got := am.Get(1)
+	if len(got) != 1 || got[0].Value != 2 {
+		t.Fatalf("Get = %v, want only the second message", got)
+	}
+	if am.Len() != 1 {
+		t.Fatalf("Len = %d, want 1", am.Len())
+	}
+}
+
+func TestFIFOSweepMovesResentToBack(t *testing.T) {
+	clock := newFakeClock()
+	am, err := NewAckManager(&Config[int64, int]{Capacity: 1, FIFO: true, Now: clock.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	am.Set(1, 0, 1)
+	clock.Add(time.Second)
+	am.Set(2, 0, 2)
+	clock.Add(time.Second)
+	am.SweepOnce(int64(2 * time.Second)) // resends 1 only
+	clock.Add(time.Second)
+	got := am.Get(int64(time.Second))
+	if len(got) != 2 || got[0].ID != 2 || got[1].ID != 1 {
+		t.Fatalf("Get = %v, want ids 2 and 1 in order", ids(got))
+	}
+}
+
+// ids returns the ids of msgs.
+func ids[flag, val any](msgs []*Msg[flag, val]) []int64 {
+	res := make([]int64, len(msgs))
+	for i, m := range msgs {
+		res[i] = m.ID
+	}
+	return res
+}
@@ -1 +1,3 @@
 module ack
+
+go 1.25
@@ -0,0 +1,75 @@
+package ack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Lifecycle is the lifecycle of an ack manager whatever its flag and value types, which lets a
+// Group hold managers of different types. It is implemented by AckManager and the managers
+// embedding it.
+type Lifecycle interface {
+	Start() bool
+	Stop() bool
+	WaitEmpty(ctx context.Context) error
+	drainAll(ctx context.Context) error
+}
+
+// drainAll is StopAndDrain for a Group, which can't return the unprocessed messages of managers of
+// different types, so only their number is reported.
+func (a *AckManager[flag, val]) drainAll(ctx context.Context) error {
+	rest, err := a.StopAndDrain(ctx)
+	if err != nil {
+		return fmt.Errorf("%d messages not drained: %w", len(rest), err)
+	}
+	return nil
+}
+
+// Group starts and stops several ack managers together, e.g. one per topic. Managers are started
+// in the order they are added and stopped in the reverse order. Add must not be called
+// concurrently with the other methods.
+type Group struct {
+	names    []string
+	managers []Lifecycle
+}
+
+// Add adds the ack manager m named name, which identifies it in errors.
+func (g *Group) Add(name string, m Lifecycle) {
+	g.names = append(g.names, name)
+	g.managers = append(g.managers, m)
+}
+
+// StartAll starts all ack managers.
+func (g *Group) StartAll() {
+	for _, m := range g.managers {
+		m.Start()
+	}
+}
+
+// StopAll waits for the pending messages of each ack manager to be acked, and stops it. A manager
+// still having pending messages when ctx is done is stopped anyway, and the others are still
+// stopped. The errors of the managers are joined, each prefixed with the name of its manager.
+func (g *Group) StopAll(ctx context.Context) error {
+	return g.each(func(m Lifecycle) error {
+		defer m.Stop()
+		return m.WaitEmpty(ctx)
+	})
+}
+
+// DrainAll calls StopAndDrain on each ack manager, so the messages buffered in async mode are
+// processed before they stop. The errors of the managers are joined like StopAll does.
+func (g *Group) DrainAll(ctx context.Context) error {
+	return g.each(func(m Lifecycle) error { return m.drainAll(ctx) })
+}
+
+// each calls fn for the ack managers in the reverse order they are added, and joins the errors.
+func (g *Group) each(fn func(Lifecycle) error) error {
+	var errs []error
+	for i := len(g.managers) - 1; i >= 0; i-- {
+		if err := fn(g.managers[i]); err != nil {
+			errs = append(errs, fmt.Errorf("ack manager %s: %w", g.names[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,93 @@
+package ack
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroupStopAllPartialFailure(t *testing.T) {
+	newManager := func() *AckManager[int, string] {
+		a, _ := NewAckManager(&Config[int, string]{Capacity: 2, Async: true, SetBufferSize: 8, AckBufferSize: 8})
+		return a
+	}
+	var g Group
+	names := []string{"orders", "payments", "emails"}
+	managers := make([]*AckManager[int, string], len(names))
+	for i, name := range names {
+		managers[i] = newManager()
+		g.Add(name, managers[i])
+	}
+	g.StartAll()
+	for _, a := range managers {
+		if a.GoroutineCount() != 1 {
+			t.Fatal("StartAll didn't start every manager")
+		}
+	}
+	// payments never gets its message acked.
+	managers[1].Set(1, 0, "v")
+	waitFor(t, "message recorded", func() bool { return managers[1].Len() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := g.StopAll(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("StopAll = %v, want the error of payments", err)
+	}
+	if want := "ack manager payments: "; !strings.HasPrefix(err.Error(), want) {
+		t.Fatalf("StopAll = %q, want it prefixed with %q", err, want)
+	}
+	for i, a := range managers {
+		if a.Stop() {
+			t.Fatalf("%s not stopped by StopAll", names[i])
+		}
+	}
+}
+
+// lifecycle is a Lifecycle recording the order of its calls into log.
+type lifecycle struct {
+	name string
+	log  *[]string
+	err  error
+}
+
+func (l *lifecycle) Start() bool {
+	*l.log = append(*l.log, "start "+l.name)
+	return true
+}
+
+func (l *lifecycle) Stop() bool {
+	*l.log = append(*l.log, "stop "+l.name)
+	return true
+}
+
+func (l *lifecycle) WaitEmpty(ctx context.Context) error { return l.err }
+
+func (l *lifecycle) drainAll(ctx context.Context) error {
+	*l.log = append(*l.log, "drain "+l.name)
+	return l.err
+}
+
+func TestGroupOrder(t *testing.T) {
+	var log []string
+	errA, errC := errors.New("a failed"), errors.New("c failed")
+	var g Group
+	g.Add("a", &lifecycle{name: "a", log: &log, err: errA})
+	g.Add("b", &lifecycle{name: "b", log: &log})
+	g.Add("c", &lifecycle{name: "c", log: &log, err: errC})
+	g.StartAll()
+	err := g.StopAll(context.Background())
+	err2 := g.DrainAll(context.Background())
+	want := []string{"start a", "start b", "start c", "stop c", "stop b", "stop a", "drain c", "drain b", "drain a"}
+	if !slices.Equal(log, want) {
+		t.Fatalf("calls %v, want %v", log, want)
+	}
+	for _, err := range []error{err, err2} {
+		if !errors.Is(err, errA) || !errors.Is(err, errC) {
+			t.Fatalf("error %v, want the errors of a and c joined", err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package ack
+
+// Hasher hashes message ids. The ack manager uses it to pick the segment a message is recorded
+// in.
+type Hasher interface {
+	Hash(id int64) uint64
+}
+
+// HasherFunc adapts an ordinary function to Hasher.
+type HasherFunc func(id int64) uint64
+
+func (f HasherFunc) Hash(id int64) uint64 {
+	return f(id)
+}
+
+// Int64Hasher is the default hasher of message ids. It keeps the id unchanged, so messages are
+// spread by id % Capacity as before.
+type Int64Hasher struct{}
+
+func (Int64Hasher) Hash(id int64) uint64 {
+	return uint64(id)
+}
+
+// FibonacciHasher scatters ids by Fibonacci multiplicative hashing. Timestamp-like ids often
+// share a stride, e.g. milliseconds in nanoseconds, and then id % Capacity puts them all in a
+// few segments. FibonacciHasher spreads them evenly over any Capacity instead.
+type FibonacciHasher struct{}
+
+func (FibonacciHasher) Hash(id int64) uint64 {
+	// 2^64 / golden ratio. The high bits of the product are mixed from all bits of id, while its
+	// low bits only depend on the low bits of id.
+	return uint64(id) * 11400714819323198485 >> 32
+}
@@ -0,0 +1,44 @@
+package ack
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// skew returns the size of the biggest segment relative to an even spread, when ids of
+// timestamps in milliseconds as nanoseconds are hashed by h into capacity segments.
+func skew(h Hasher, capacity, n int) float64 {
+	counts := make([]int, capacity)
+	base := time.Unix(1_700_000_000, 0).UnixNano()
+	for i := range n {
+		counts[h.Hash(base+int64(i)*int64(time.Millisecond))%uint64(capacity)]++
+	}
+	return float64(slices.Max(counts)) * float64(capacity) / float64(n)
+}
+
+func TestFibonacciHasherSpreadsStrides(t *testing.T) {
+	if s := skew(Int64Hasher{}, 16, 100_000); s < 8 {
+		t.Fatalf("modulo skew = %.2f, want millisecond ids gathered in few segments", s)
+	}
+	if s := skew(FibonacciHasher{}, 16, 100_000); s > 1.1 {
+		t.Fatalf("FibonacciHasher skew = %.2f, want about 1", s)
+	}
+}
+
+// BenchmarkHasherSkew reports how unevenly monotonically increasing timestamp ids spread over 16
+// segments, 1 being even, by modulo and by FibonacciHasher.
+func BenchmarkHasherSkew(b *testing.B) {
+	for _, bb := range []struct {
+		name string
+		h    Hasher
+	}{{"modulo", Int64Hasher{}}, {"fibonacci", FibonacciHasher{}}} {
+		b.Run(bb.name, func(b *testing.B) {
+			var s float64
+			for b.Loop() {
+				s = skew(bb.h, 16, 10_000)
+			}
+			b.ReportMetric(s, "skew")
+		})
+	}
+}
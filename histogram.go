@@ -0,0 +1,80 @@
+package ack
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Bucket is a bucket of the ack latency histogram. Count is the number of messages acked within
+// UpperBound but not within UpperBound of the previous bucket. The last bucket is unbounded and
+// its UpperBound is math.MaxInt64.
+type Bucket struct {
+	UpperBound time.Duration
+	Count      int64
+}
+
+// histogram counts ack latencies into fixed buckets.
+type histogram struct {
+	bounds []time.Duration
+	counts []int64 // the extra last one counts latencies beyond all bounds
+}
+
+func newHistogram(bounds []time.Duration) *histogram {
+	bounds = slices.Clone(bounds)
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+	return &histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+	atomic.AddInt64(&h.counts[i], 1)
+}
+
+func (h *histogram) reset() {
+	for i := range h.counts {
+		atomic.StoreInt64(&h.counts[i], 0)
+	}
+}
+
+func (h *histogram) buckets() []Bucket {
+	res := make([]Bucket, len(h.counts))
+	for i := range h.counts {
+		res[i].UpperBound = math.MaxInt64
+		if i < len(h.bounds) {
+			res[i].UpperBound = h.bounds[i]
+		}
+		res[i].Count = atomic.LoadInt64(&h.counts[i])
+	}
+	return res
+}
+
+// LatencyHistogram returns the distribution of ack latency, the time from a message is set to it
+// is acked. It returns nil if LatencyBuckets is not configured.
+func (a *AckManager[flag, val]) LatencyHistogram() []Bucket {
+	if a.latency == nil {
+		return nil
+	}
+	return a.latency.buckets()
+}
+
+// AgeHistogram counts pending messages by age, the time since they are set or last resent, in a
+// single pass. buckets are upper bounds in ascending order, and the result has one more count
+// than buckets: count i is of the messages not older than buckets[i] but older than
+// buckets[i-1], and the last one is of the messages older than all buckets.
+func (a *AckManager[flag, val]) AgeHistogram(buckets []time.Duration) []int {
+	counts := make([]int, len(buckets)+1)
+	now := a.now()
+	a.ForEach(func(m *Msg[flag, val]) bool {
+		age := time.Duration(now - m.Timestamp)
+		counts[sort.Search(len(buckets), func(i int) bool { return age <= buckets[i] })]++
+		return true
+	})
+	return counts
+}
@@ -0,0 +1,65 @@
+package ack
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	clock := newFakeClock()
+	a, err := NewAckManager(&Config[int, string]{
+		Capacity:       2,
+		Now:            clock.Now,
+		LatencyBuckets: []time.Duration{100 * time.Millisecond, 10 * time.Millisecond, time.Second},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, latency := range []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+		2 * time.Second} {
+		a.Set(int64(id), 0, "v")
+		clock.Add(latency)
+		a.Ack(int64(id), 0)
+	}
+	want := []Bucket{
+		{UpperBound: 10 * time.Millisecond, Count: 2},
+		{UpperBound: 100 * time.Millisecond, Count: 1},
+		{UpperBound: time.Second, Count: 0},
+		{UpperBound: math.MaxInt64, Count: 1},
+	}
+	if got := a.LatencyHistogram(); !slices.Equal(got, want) {
+		t.Fatalf("LatencyHistogram = %v, want %v", got, want)
+	}
+}
+
+func TestLatencyHistogramDisabled(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 1})
+	a.Set(1, 0, "v")
+	a.Ack(1, 0)
+	if got := a.LatencyHistogram(); got != nil {
+		t.Fatalf("LatencyHistogram = %v without LatencyBuckets, want nil", got)
+	}
+}
+
+func TestAgeHistogram(t *testing.T) {
+	clock := newFakeClock()
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 4, Now: clock.Now})
+	// ages of 10s, 6s, 5s, 3s and 0s.
+	for id, d := range []time.Duration{4 * time.Second, time.Second, 2 * time.Second, 3 * time.Second, 0} {
+		a.Set(int64(id), 0, "v")
+		clock.Add(d)
+	}
+	buckets := []time.Duration{time.Second, 5 * time.Second, 10 * time.Second}
+	if got := a.AgeHistogram(buckets); !slices.Equal(got, []int{1, 2, 2, 0}) {
+		t.Fatalf("AgeHistogram = %v, want [1 2 2 0]", got)
+	}
+	clock.Add(time.Second)
+	if got := a.AgeHistogram(buckets); !slices.Equal(got, []int{1, 1, 2, 1}) {
+		t.Fatalf("AgeHistogram a second later = %v, want [1 1 2 1]", got)
+	}
+	if a.Len() != 5 {
+		t.Fatal("AgeHistogram removed messages")
+	}
+}
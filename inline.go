@@ -0,0 +1,116 @@
+package ack
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// InlineManager is a compact sync ack manager of int64 values, like balances or offsets. Messages
+// are stored by value in the segment maps instead of by pointer, which saves an allocation per
+// message and lets the garbage collector skip the maps when flag holds no pointers, so it suits
+// millions of pending messages of tiny values. It only offers the basic Set, Ack and Get, use
+// AckManager for anything else.
+type InlineManager[flag any] struct {
+	canAck   CanAck[flag]
+	segments []inlineSegment[flag]
+}
+
+// inlineSegment is a segment of an InlineManager.
+type inlineSegment[flag any] struct {
+	sync.RWMutex
+	msgs map[int64]inlineMsg[flag]
+}
+
+// inlineMsg is a message stored by value by InlineManager.
+type inlineMsg[flag any] struct {
+	Timestamp int64
+	Flag      flag
+	Value     int64
+}
+
+// NewInlineManager creates an InlineManager of capacity segments. canAck decides whether a message
+// can be acked like Config field CanAck does, messages are acked by any flag if it is nil.
+func NewInlineManager[flag any](capacity int, canAck CanAck[flag]) (*InlineManager[flag], error) {
+	if capacity <= 0 {
+		return nil, errors.New("capacity should be more than 0")
+	}
+	segments := make([]inlineSegment[flag], capacity)
+	for i := range segments {
+		segments[i].msgs = map[int64]inlineMsg[flag]{}
+	}
+	return &InlineManager[flag]{canAck: canAck, segments: segments}, nil
+}
+
+// segment returns the segment of id.
+func (a *InlineManager[flag]) segment(id int64) *inlineSegment[flag] {
+	return &a.segments[Int64Hasher{}.Hash(id)%uint64(len(a.segments))]
+}
+
+// Set records the message of id, replacing the pending one with the same id.
+func (a *InlineManager[flag]) Set(id int64, f flag, v int64) {
+	s := a.segment(id)
+	s.Lock()
+	s.msgs[id] = inlineMsg[flag]{Timestamp: time.Now().UnixNano(), Flag: f, Value: v}
+	s.Unlock()
+}
+
+// Ack removes the message of id if it can be acked by f, and reports whether it is removed.
+func (a *InlineManager[flag]) Ack(id int64, f flag) bool {
+	s := a.segment(id)
+	s.Lock()
+	defer s.Unlock()
+	m, ok := s.msgs[id]
+	if !ok || (a.canAck != nil && !a.canAck(m.Flag, f)) {
+		return false
+	}
+	delete(s.msgs, id)
+	return true
+}
+
+// Value returns the value of the pending message of id.
+func (a *InlineManager[flag]) Value(id int64) (int64, bool) {
+	s := a.segment(id)
+	s.RLock()
+	m, ok := s.msgs[id]
+	s.RUnlock()
+	return m.Value, ok
+}
+
+// Get returns messages not acked after duration nanoseconds. Like AckManager.Get, it returns
+// nothing if duration is not positive.
+func (a *InlineManager[flag]) Get(duration int64) []Entry[flag, int64] {
+	if duration <= 0 {
+		return nil
+	}
+	var res []Entry[flag, int64]
+	now := time.Now().UnixNano()
+	for i := range a.segments {
+		s := &a.segments[i]
+		s.RLock()
+		for id, m := range s.msgs {
+			if now-m.Timestamp >= duration {
+				res = append(res, Entry[flag, int64]{
+					ID:        id,
+					Flag:      m.Flag,
+					Value:     m.Value,
+					Timestamp: time.Unix(0, m.Timestamp),
+				})
+			}
+		}
+		s.RUnlock()
+	}
+	return res
+}
+
+// Len returns the number of pending messages.
+func (a *InlineManager[flag]) Len() int {
+	n := 0
+	for i := range a.segments {
+		s := &a.segments[i]
+		s.RLock()
+		n += len(s.msgs)
+		s.RUnlock()
+	}
+	return n
+}
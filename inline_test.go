@@ -0,0 +1,81 @@
+package ack
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestInlineManager(t *testing.T) {
+	a, err := NewInlineManager(4, LessOrEqual[int64]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Set(1, 5, 100)
+	a.Set(2, 5, 200)
+	if v, ok := a.Value(1); !ok || v != 100 {
+		t.Fatalf("Value(1) = %d, %v, want 100", v, ok)
+	}
+	if a.Ack(1, 4) {
+		t.Fatal("ack rejected by CanAck removed the message")
+	}
+	if !a.Ack(1, 5) {
+		t.Fatal("Ack = false, want true")
+	}
+	if _, ok := a.Value(1); ok || a.Len() != 1 {
+		t.Fatalf("Value(1) found or Len = %d after ack, want 1", a.Len())
+	}
+}
+
+func TestInlineManagerGet(t *testing.T) {
+	a, err := NewInlineManager[int64](2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Set(1, 0, 10)
+	if got := a.Get(0); len(got) != 0 {
+		t.Fatalf("Get(0) = %v, want nothing like AckManager.Get", got)
+	}
+	if got := a.Get(int64(time.Hour)); len(got) != 0 {
+		t.Fatalf("Get(1h) = %v, want nothing", got)
+	}
+	time.Sleep(time.Millisecond)
+	got := a.Get(1)
+	if len(got) != 1 || got[0].ID != 1 || got[0].Value != 10 {
+		t.Fatalf("Get = %+v, want message 1", got)
+	}
+}
+
+// BenchmarkInlineVsPointer overwrites messages among millions of pending ones, reporting the
+// allocations of Set and the pause of a full GC of the pending messages.
+func BenchmarkInlineVsPointer(b *testing.B) {
+	const pending = 2_000_000
+	b.Run("inline", func(b *testing.B) {
+		a, _ := NewInlineManager(16, LessOrEqual[int64]())
+		for i := int64(0); i < pending; i++ {
+			a.Set(i, 0, i)
+		}
+		benchmarkOverwrite(b, func(id int64) { a.Set(id, 0, id) })
+		runtime.KeepAlive(a)
+	})
+	b.Run("pointer", func(b *testing.B) {
+		a, _ := NewAckManager(&Config[int64, int64]{Capacity: 16, CanAck: LessOrEqual[int64]()})
+		for i := int64(0); i < pending; i++ {
+			a.Set(i, 0, i)
+		}
+		benchmarkOverwrite(b, func(id int64) { a.Set(id, 0, id) })
+		runtime.KeepAlive(a)
+	})
+}
+
+func benchmarkOverwrite(b *testing.B, set func(id int64)) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; b.Loop(); i++ {
+		set(int64(i % 2_000_000))
+	}
+	b.StopTimer()
+	start := time.Now()
+	runtime.GC()
+	b.ReportMetric(float64(time.Since(start).Microseconds()), "gc-µs")
+}
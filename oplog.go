@@ -0,0 +1,112 @@
+package ack
+
+import (
+	"sync"
+	"time"
+)
+
+// OpOutcome is the outcome of an operation recorded by TraceOps.
+type OpOutcome int
+
+const (
+	// OpRecorded is a set recording a new message.
+	OpRecorded OpOutcome = iota
+	// OpOverwritten is a set replacing a pending message of the same id.
+	OpOverwritten
+	// OpAcked is an ack removing the message.
+	OpAcked
+	// OpRejected is an ack of a pending message rejected by CanAck.
+	OpRejected
+	// OpNotFound is an ack of an id not pending.
+	OpNotFound
+	// OpDuplicate is an ack detected as duplicate by RecentAcks.
+	OpDuplicate
+	// OpKept is a set discarded because the pending message is kept, like a stale sequence of
+	// SeqManager.
+	OpKept
+)
+
+func (o OpOutcome) String() string {
+	switch o {
+	case OpRecorded:
+		return "recorded"
+	case OpOverwritten:
+		return "overwritten"
+	case OpAcked:
+		return "acked"
+	case OpRejected:
+		return "rejected"
+	case OpNotFound:
+		return "not found"
+	case OpDuplicate:
+		return "duplicate"
+	case OpKept:
+		return "kept"
+	}
+	return "unknown"
+}
+
+// op returns the OpOutcome of a set with outcome o.
+func (o setOutcome) op() OpOutcome {
+	switch o {
+	case setOverwritten:
+		return OpOverwritten
+	case setKeptOld:
+		return OpKept
+	}
+	return OpRecorded
+}
+
+// Op is a set or an ack processed by the ack manager, recorded when TraceOps is set.
+type Op[flag any] struct {
+	// Ack is true for an ack, false for a set.
+	Ack     bool
+	ID      int64
+	Flag    flag
+	Time    time.Time
+	Outcome OpOutcome
+}
+
+// opLog is a ring buffer of the last operations.
+type opLog[flag any] struct {
+	mu   sync.Mutex
+	ops  []Op[flag]
+	next int
+	full bool
+}
+
+func newOpLog[flag any](size int) *opLog[flag] {
+	return &opLog[flag]{ops: make([]Op[flag], size)}
+}
+
+func (l *opLog[flag]) add(op Op[flag]) {
+	l.mu.Lock()
+	l.ops[l.next] = op
+	if l.next++; l.next == len(l.ops) {
+		l.next, l.full = 0, true
+	}
+	l.mu.Unlock()
+}
+
+// RecentOps returns the last sets and acks processed, oldest first, up to TraceOps of them. It
+// helps to find out why a message is never acked: whether its ack arrived and what happened to
+// it. It returns nil if TraceOps is not set.
+func (a *AckManager[flag, val]) RecentOps() []Op[flag] {
+	l := a.opLog
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]Op[flag](nil), l.ops[:l.next]...)
+	}
+	return append(append(make([]Op[flag], 0, len(l.ops)), l.ops[l.next:]...), l.ops[:l.next]...)
+}
+
+// traceOp records an operation if TraceOps is set.
+func (a *AckManager[flag, val]) traceOp(ack bool, id int64, f flag, outcome OpOutcome) {
+	if a.opLog != nil {
+		a.opLog.add(Op[flag]{Ack: ack, ID: id, Flag: f, Time: a.clock(), Outcome: outcome})
+	}
+}
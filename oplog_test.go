@@ -0,0 +1,54 @@
+package ack
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRecentOps(t *testing.T) {
+	clock := newFakeClock()
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:   2,
+		Now:        clock.Now,
+		TraceOps:   4,
+		CanAck:     LessOrEqual[int](),
+		RecentAcks: 8,
+	})
+	if ops := a.RecentOps(); len(ops) != 0 {
+		t.Fatalf("RecentOps = %v before any op", ops)
+	}
+	op := func(ack bool, id int64, f int, outcome OpOutcome) Op[int] {
+		return Op[int]{Ack: ack, ID: id, Flag: f, Time: clock.Now(), Outcome: outcome}
+	}
+	a.Set(1, 1, "v")
+	a.Set(1, 2, "v")
+	want := []Op[int]{op(false, 1, 1, OpRecorded), op(false, 1, 2, OpOverwritten)}
+	if ops := a.RecentOps(); !slices.Equal(ops, want) {
+		t.Fatalf("RecentOps = %v, want %v", ops, want)
+	}
+
+	// the ring wraps and keeps the last 4 ops, oldest first.
+	a.Ack(1, 1)
+	a.Ack(1, 2)
+	a.Ack(1, 2)
+	a.Ack(2, 0)
+	want = []Op[int]{
+		op(true, 1, 1, OpRejected),
+		op(true, 1, 2, OpAcked),
+		op(true, 1, 2, OpDuplicate),
+		op(true, 2, 0, OpNotFound),
+	}
+	if ops := a.RecentOps(); !slices.Equal(ops, want) {
+		t.Fatalf("RecentOps = %v, want %v", ops, want)
+	}
+	a.Set(3, 0, "v")
+	if ops := a.RecentOps(); len(ops) != 4 || ops[0] != want[1] || ops[3] != op(false, 3, 0, OpRecorded) {
+		t.Fatalf("RecentOps = %v after wrapping again", ops)
+	}
+
+	untraced, _ := NewAckManager(&Config[int, string]{Capacity: 2})
+	untraced.Set(1, 0, "v")
+	if ops := untraced.RecentOps(); ops != nil {
+		t.Fatalf("RecentOps = %v without TraceOps, want nil", ops)
+	}
+}
@@ -0,0 +1,47 @@
+// Package otelack adapts an OpenTelemetry tracer to ack.Tracer. It is a separate module, so that
+// the ack module keeps depending on the standard library only.
+package otelack
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"ack"
+)
+
+// Tracer is an ack.Tracer starting spans by an OpenTelemetry tracer. The span of a set is a child
+// of the span of the context passed to SetContext, and its span context is injected into the
+// Meta of the message. The span of the ack is linked to it, as the ack usually comes from
+// another request.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+var _ ack.Tracer = (*Tracer)(nil)
+
+// New creates a Tracer starting spans by tracer. The span context is carried in the message Meta
+// by the W3C trace context propagator.
+func New(tracer trace.Tracer) *Tracer {
+	return &Tracer{tracer: tracer, propagator: propagation.TraceContext{}}
+}
+
+// StartSpan starts the span "ack.set" or "ack.ack" of op with the message id as attribute.
+func (t *Tracer) StartSpan(ctx context.Context, op string, id int64, meta map[string]string) (context.Context,
+	func()) {
+	opts := []trace.SpanStartOption{trace.WithAttributes(attribute.Int64("ack.id", id))}
+	if op == "ack" {
+		set := t.propagator.Extract(context.Background(), propagation.MapCarrier(meta))
+		if sc := trace.SpanContextFromContext(set); sc.IsValid() {
+			opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+		}
+	}
+	ctx, span := t.tracer.Start(ctx, "ack."+op, opts...)
+	if op == "set" {
+		t.propagator.Inject(ctx, propagation.MapCarrier(meta))
+	}
+	return ctx, func() { span.End() }
+}
@@ -0,0 +1,48 @@
+package otelack
+
+import (
+	"context"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"ack"
+)
+
+func TestTracer(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	tracer := provider.Tracer("test")
+	am, err := ack.NewAckManager(&ack.Config[int, string]{Capacity: 2, Tracer: New(tracer)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, request := tracer.Start(context.Background(), "request")
+	if err := am.SetContext(ctx, 1, 0, "v"); err != nil {
+		t.Fatal(err)
+	}
+	request.End()
+	if err := am.Ack(1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := rec.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("%d spans ended, want 3", len(spans))
+	}
+	set, req, acked := spans[0], spans[1], spans[2]
+	if set.Name() != "ack.set" || acked.Name() != "ack.ack" {
+		t.Fatalf("spans = %s, %s, want ack.set, ack.ack", set.Name(), acked.Name())
+	}
+	if set.Parent().SpanID() != req.SpanContext().SpanID() {
+		t.Fatal("the set span is not a child of the request span")
+	}
+	if links := acked.Links(); len(links) != 1 || links[0].SpanContext.SpanID() != set.SpanContext().SpanID() {
+		t.Fatalf("links of the ack span = %v, want the set span", links)
+	}
+	if acked.Parent().IsValid() {
+		t.Fatal("the ack span has a parent, want a root span linked to the set")
+	}
+}
@@ -0,0 +1,46 @@
+package ack
+
+import "sync"
+
+// reaper queues the messages of SetWithContext whose context is done, so that at most max
+// goroutines remove them at a time. There is no goroutine to start or stop: the goroutine queuing
+// a message stays to remove the queued messages if fewer than max do, otherwise it returns.
+type reaper[flag, val any] struct {
+	mu      sync.Mutex
+	queue   []*Msg[flag, val]
+	running int
+	max     int
+}
+
+// reap removes m, set by SetWithContext, unless it has been acked or set again.
+func (a *AckManager[flag, val]) reap(m *Msg[flag, val]) {
+	rp := a.reaper
+	if rp == nil {
+		a.cancel(m)
+		return
+	}
+	rp.mu.Lock()
+	rp.queue = append(rp.queue, m)
+	if rp.running >= rp.max {
+		rp.mu.Unlock()
+		return
+	}
+	rp.running++
+	for len(rp.queue) > 0 {
+		m := rp.queue[0]
+		rp.queue[0] = nil
+		rp.queue = rp.queue[1:]
+		rp.mu.Unlock()
+		a.cancel(m)
+		rp.mu.Lock()
+	}
+	rp.running--
+	rp.mu.Unlock()
+}
+
+// cancel removes m because its context is done.
+func (a *AckManager[flag, val]) cancel(m *Msg[flag, val]) {
+	if a.segment(m.ID).Evict(m, false) {
+		a.removed(RemoveCanceled, m)
+	}
+}
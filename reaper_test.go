@@ -0,0 +1,47 @@
+package ack
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestContextReapersBoundRemovals(t *testing.T) {
+	const n = 1000
+	var running, peak int32
+	var wg sync.WaitGroup
+	wg.Add(n)
+	am, err := NewAckManager(&Config[int64, int]{
+		Capacity:       4,
+		ContextReapers: 2,
+		OnRemove: func(m *Msg[int64, int], reason RemoveReason) {
+			r := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if r <= p || atomic.CompareAndSwapInt32(&peak, p, r) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Microsecond)
+			atomic.AddInt32(&running, -1)
+			wg.Done()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := int64(0); i < n; i++ {
+		am.SetWithContext(ctx, i, 0, 0)
+	}
+	cancel()
+	wg.Wait()
+	if am.Len() != 0 {
+		t.Fatalf("Len = %d, want 0", am.Len())
+	}
+	if peak > 2 {
+		t.Fatalf("%d concurrent removals, want at most 2", peak)
+	}
+}
@@ -1,88 +1,720 @@
 package ack
 
 import (
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// msg is internal encapsulation of the sending message.
-type msg[flag, val any] struct {
+// Msg is a recorded message, as passed to the callbacks and returned by Get and the other
+// readers. A recorded Msg is never modified, as it may be held by them: a copy with the changes
+// replaces it.
+type Msg[flag, val any] struct {
 	// message ID
 	ID int64
 	// Timestamp is the time when message is sent.
 	Timestamp int64
+	// Created is the time when message is first recorded. Unlike Timestamp, it's kept when the
+	// message is resent.
+	Created int64
 	// Flag is used in some situation. see comment in Config field CanAck.
 	Flag flag
 	// Value is the actual sent message.
 	Value val
+	// Retries is the number of times the message has been resent by the sweeper.
+	Retries int
+	// NotBefore is the time before which the sweeper won't resend the message again and Get won't
+	// return it, that is the message is leased until then. See comment in Config field Backoff.
+	NotBefore int64
+	// Pinned messages are never evicted by MaxTotal, but are acked and swept as usual. It is kept
+	// when the message is resent or set again. See Pin.
+	Pinned bool
+	// Parts are flags of the parts not acked yet, only used in MultiFlag mode.
+	Parts []flag
+	// Meta is metadata carried with the message, like a trace id, set by SetWithMeta. It is kept
+	// when the message is resent, and must not be modified once set.
+	Meta map[string]string
+
+	size    int64  // size of Value measured by SizeOf
+	version uint64 // version of the last change, only used with TrackChanges
+	serial  uint64 // unique per recorded message and kept by its copies, see nextSerial
+	// isAck marks a buffered ack, and reply receives its result if it's buffered by AckAsync.
+	isAck bool
+	reply chan bool
+	// reserved marks a message already counted as pending by waitRoom, see MaxPending.
+	reserved bool
+}
+
+// reallocateRatio is how many times the peak size of a segment must be of its current size for
+// ReAllocate to rebuild it.
+const reallocateRatio = 2
+
+func newMsg[flag, val any](id int64, f flag, v val, ts int64) *Msg[flag, val] {
+	return &Msg[flag, val]{
+		ID:        id,
+		Timestamp: ts,
+		Created:   ts,
+		Flag:      f,
+		Value:     v,
+	}
 }
 
 // recorder records messages.
 type recorder[flag, val any] struct {
-	sync.RWMutex
-	msgs map[int64]*msg[flag, val] // msgID => msg
+	locker
+	msgs map[int64]*Msg[flag, val] // msgID => msg
 	am   *AckManager[flag, val]
+	// peak is the biggest size of msgs since it's allocated. Maps never shrink, so it is about the
+	// memory held by msgs.
+	peak int
+	// queued holds messages waiting behind the one in msgs with the same id, oldest first. It is
+	// only used when OrderedPerKey is set.
+	queued map[int64][]*Msg[flag, val]
+	// oldest caches the message with the smallest timestamp. It is stale once the message is no
+	// longer in msgs, as messages are replaced instead of modified.
+	oldest atomic.Pointer[Msg[flag, val]]
+	// fifo holds messages in the order they are recorded or refreshed, only used in FIFO mode.
+	// Entries are not removed with their messages but skipped as stale, see live.
+	fifo []*Msg[flag, val]
+	// tombstones are the versions of removals by id, only used with TrackChanges.
+	tombstones map[int64]uint64
+
+	// contended counts lock acquisitions that had to wait, only when trackContention is set.
+	trackContention bool
+	contended       int64
+
+	// sets, acks and gets count the operations on the segment, only when trackAccess is set.
+	trackAccess      bool
+	sets, acks, gets int64
 }
 
 func newRecorder[flag, val any](am *AckManager[flag, val]) *recorder[flag, val] {
-	return &recorder[flag, val]{
-		msgs: map[int64]*msg[flag, val]{},
-		am:   am,
+	r := &recorder[flag, val]{
+		locker:          newLocker(am.lockKind),
+		msgs:            map[int64]*Msg[flag, val]{},
+		am:              am,
+		trackContention: am.trackContention,
+		trackAccess:     am.trackAccess,
+	}
+	if am.orderedPerKey {
+		r.queued = map[int64][]*Msg[flag, val]{}
+	}
+	if am.trackChanges {
+		r.tombstones = map[int64]uint64{}
 	}
+	return r
+}
+
+// locker is the lock of a recorder.
+type locker interface {
+	Lock()
+	Unlock()
+	TryLock() bool
+	RLock()
+	RUnlock()
+	TryRLock() bool
+}
+
+func newLocker(kind LockKind) locker {
+	if kind == LockPlain {
+		return &mutex{}
+	}
+	return &sync.RWMutex{}
+}
+
+// mutex is a locker whose read lock is exclusive like the write lock.
+type mutex struct {
+	sync.Mutex
+}
+
+func (m *mutex) RLock() {
+	m.Lock()
+}
+
+func (m *mutex) RUnlock() {
+	m.Unlock()
 }
 
-// Set messages.
-func (r *recorder[flag, val]) Set(id int64, f flag, v val) {
+func (m *mutex) TryRLock() bool {
+	return m.TryLock()
+}
+
+// lock acquires the write lock, counting the acquisition as contended if the fast path fails.
+func (r *recorder[flag, val]) lock() {
+	if r.trackContention {
+		if r.TryLock() {
+			return
+		}
+		atomic.AddInt64(&r.contended, 1)
+	}
 	r.Lock()
-	m := &msg[flag, val]{
-		ID:        id,
-		Timestamp: time.Now().UnixNano(),
-		Flag:      f,
-		Value:     v,
+}
+
+// rlock acquires the read lock, counting the acquisition as contended if the fast path fails.
+func (r *recorder[flag, val]) rlock() {
+	if r.trackContention {
+		if r.TryRLock() {
+			return
+		}
+		atomic.AddInt64(&r.contended, 1)
+	}
+	r.RLock()
+}
+
+// outcomes of recorder.Set.
+type setOutcome int
+
+const (
+	setRecorded    setOutcome = iota // a new message is recorded, or queued in OrderedPerKey mode
+	setOverwritten                   // the pending message of the same id is replaced
+	setKeptOld                       // m is discarded as keepOld keeps the pending message
+)
+
+// Set messages, it returns whether m is recorded, overwrites an existing message or is discarded.
+func (r *recorder[flag, val]) Set(m *Msg[flag, val]) setOutcome {
+	if r.trackAccess {
+		atomic.AddInt64(&r.sets, 1)
+	}
+	id, reserved := m.ID, m.reserved
+	m.reserved = false
+	r.lock()
+	old, overwritten := r.msgs[id]
+	if overwritten && r.am.keepOld != nil && r.am.keepOld(old.Flag, m.Flag) {
+		r.Unlock()
+		return setKeptOld
+	}
+	if r.am.recentAcks != nil {
+		r.am.recentAcks.Remove(id)
+	}
+	bytes := m.size
+	switch {
+	case overwritten && r.queued != nil:
+		r.queued[id] = append(r.queued[id], m)
+		overwritten = false
+	case r.am.multiFlag:
+		if overwritten {
+			c := *old
+			c.Parts = append(slices.Clip(old.Parts), m.Flag)
+			m = &c
+			bytes = 0
+		} else if m.Parts == nil {
+			m.Parts = []flag{m.Flag}
+		}
+		r.changed(m)
+		r.msgs[id] = m
+		r.older(m)
+		if !overwritten {
+			r.push(m)
+		}
+	default:
+		if overwritten {
+			bytes -= old.size
+			if !r.am.resetRetriesOnSet && m.Retries == 0 {
+				m.Retries = old.Retries
+			}
+			m.Pinned = m.Pinned || old.Pinned
+		}
+		r.changed(m)
+		r.msgs[id] = m
+		r.older(m)
+		r.push(m)
+	}
+	if r.am.fifo && len(r.fifo) > 2*len(r.msgs)+fifoCompactSlack {
+		r.rebuildFIFO()
+	}
+	if !overwritten {
+		r.am.added(reserved)
 	}
-	r.msgs[id] = m
+	if bytes != 0 {
+		atomic.AddInt64(&r.am.bytes, bytes)
+	}
+	r.peak = max(r.peak, len(r.msgs))
 	r.Unlock()
+	if overwritten {
+		return setOverwritten
+	}
+	return setRecorded
 }
 
-// Remove messages if canAck is true.
-func (r *recorder[flag, val]) Remove(id int64, f flag) {
-	r.Lock()
+// older caches m as the oldest message if it is older than the cached one. It must be called
+// with the write lock held.
+func (r *recorder[flag, val]) older(m *Msg[flag, val]) {
+	if o := r.oldest.Load(); o != nil && m.Timestamp < o.Timestamp {
+		r.oldest.Store(m)
+	}
+}
+
+// delete removes the message of id, and the next queued message of the same id takes its place.
+func (r *recorder[flag, val]) delete(id int64) {
+	if m := r.msgs[id]; m.size != 0 {
+		atomic.AddInt64(&r.am.bytes, -m.size)
+	}
+	next, ok := r.queued[id]
+	if !ok {
+		delete(r.msgs, id)
+		r.deleted(id)
+		return
+	}
+	r.changed(next[0])
+	r.msgs[id] = next[0]
+	r.older(next[0])
+	r.push(next[0])
+	if len(next) == 1 {
+		delete(r.queued, id)
+	} else {
+		r.queued[id] = next[1:]
+	}
+}
+
+// Remove messages if canAck is true, and returns the removed message or nil. onAck, if it is not
+// nil, is called with the message under the lock before it's removed.
+func (r *recorder[flag, val]) Remove(id int64, f flag, onAck func(*Msg[flag, val])) *Msg[flag, val] {
+	if r.trackAccess {
+		atomic.AddInt64(&r.acks, 1)
+	}
+	r.lock()
 	m, ok := r.msgs[id]
 	canAck := true
-	if r.am.canAck != nil {
-		canAck = r.am.canAck(m.Flag, f)
+	var p any
+	switch {
+	case !ok:
+	case r.am.multiFlag:
+		canAck, p = r.ackPart(m, f)
+	case r.am.canAck != nil:
+		canAck, p = r.am.callCanAck(m.Flag, f)
+		if !canAck {
+			atomic.AddInt64(&r.am.rejectedAcks, 1)
+		}
 	}
+	empty := false
 	if ok && canAck {
-		delete(r.msgs, id)
+		if onAck != nil {
+			onAck(m)
+		}
+		r.delete(id)
+		empty = r.am.release(1)
+		if r.am.latency != nil {
+			r.am.latency.observe(time.Duration(r.am.now() - m.Timestamp))
+		}
+	} else {
+		m = nil
 	}
 	r.Unlock()
+	if p != nil {
+		r.am.recovered(p)
+	}
+	if empty {
+		r.am.notifyEmpty()
+	}
+	if m != nil {
+		r.am.removed(RemoveAcked, m)
+	}
+	return m
 }
 
-// Get messages list have not acked after duration.
-func (r *recorder[flag, val]) Get(duration int64) []*msg[flag, val] {
+// AckWhere removes messages satisfying pred if canAck allows them to be acked by f, and returns
+// the number of removed messages.
+func (r *recorder[flag, val]) AckWhere(pred func(*Msg[flag, val]) bool, f flag) int {
+	var panics []any
+	var removed []*Msg[flag, val]
+	n := 0
+	now := r.am.now()
+	r.lock()
+	for id, m := range r.msgs {
+		if !pred(m) {
+			continue
+		}
+		if r.am.canAck != nil {
+			canAck, p := r.am.callCanAck(m.Flag, f)
+			if p != nil {
+				panics = append(panics, p)
+			}
+			if !canAck {
+				continue
+			}
+		}
+		r.delete(id)
+		n++
+		if r.am.onRemove != nil {
+			removed = append(removed, m)
+		}
+		if r.am.latency != nil {
+			r.am.latency.observe(time.Duration(now - m.Timestamp))
+		}
+	}
+	empty := n > 0 && r.am.release(n)
+	r.Unlock()
+	for _, p := range panics {
+		r.am.recovered(p)
+	}
+	if empty {
+		r.am.notifyEmpty()
+	}
+	r.am.removed(RemoveAcked, removed...)
+	return n
+}
+
+// ExtractWhere removes messages satisfying pred and appends them to dst.
+func (r *recorder[flag, val]) ExtractWhere(pred func(*Msg[flag, val]) bool, dst []*Msg[flag, val]) []*Msg[flag, val] {
+	n, start := 0, len(dst)
+	r.lock()
+	for id, m := range r.msgs {
+		if !pred(m) {
+			continue
+		}
+		queued := r.queued[id]
+		delete(r.queued, id)
+		r.delete(id)
+		for _, q := range queued {
+			if q.size != 0 {
+				atomic.AddInt64(&r.am.bytes, -q.size)
+			}
+		}
+		dst = append(append(dst, m), queued...)
+		n += 1 + len(queued)
+	}
+	empty := n > 0 && r.am.release(n)
+	r.Unlock()
+	if empty {
+		r.am.notifyEmpty()
+	}
+	r.am.removed(RemoveExtracted, dst[start:]...)
+	return dst
+}
+
+// ackPart removes the first part of m matching f, and reports whether it was the last part. Parts
+// are matched by canAck if it is set, otherwise by ==.
+func (r *recorder[flag, val]) ackPart(m *Msg[flag, val], f flag) (last bool, p any) {
+	for i, part := range m.Parts {
+		match := true
+		if r.am.canAck != nil {
+			match, p = r.am.callCanAck(part, f)
+		} else {
+			match = any(part) == any(f)
+		}
+		if !match {
+			if p != nil {
+				return false, p
+			}
+			continue
+		}
+		if len(m.Parts) == 1 {
+			return true, p
+		}
+		c := *m
+		c.Parts = slices.Delete(slices.Clone(m.Parts), i, i+1)
+		r.changed(&c)
+		r.msgs[m.ID] = &c
+		return false, p
+	}
+	return false, nil
+}
+
+// deadlineCheckInterval is how many messages are scanned between checks of the GetDeadline.
+const deadlineCheckInterval = 256
+
+// GetInto appends messages have not acked after duration and not leased to dst. If deadline is not zero, the
+// scan stops early once it passes and GetInto reports that the result is partial.
+func (r *recorder[flag, val]) GetInto(duration int64, dst []*Msg[flag, val], deadline time.Time) ([]*Msg[flag, val], bool) {
+	if r.trackAccess {
+		atomic.AddInt64(&r.gets, 1)
+	}
 	if duration <= 0 {
-		return []*msg[flag, val]{}
+		return dst, false
 	}
 
-	res := make([]*msg[flag, val], 0)
-	now := time.Now().UnixNano()
-	r.RLock()
+	n := 0
+	partial := false
+	now := r.am.now()
+	r.rlock()
+	for m := range r.all() {
+		if now-m.Timestamp < duration {
+			if r.am.fifo {
+				break
+			}
+		} else if now >= m.NotBefore {
+			dst = append(dst, m)
+		}
+		if n++; !deadline.IsZero() && n%deadlineCheckInterval == 0 && time.Now().After(deadline) {
+			partial = true
+			break
+		}
+	}
+	r.RUnlock()
+	return dst, partial
+}
+
+// HasExpired reports whether a message not leased has not been acked after duration at now.
+func (r *recorder[flag, val]) HasExpired(duration, now int64) bool {
+	if o := r.Oldest(); o == nil || now-o.Timestamp < duration {
+		return false
+	}
+	r.rlock()
+	defer r.RUnlock()
+	for m := range r.all() {
+		if now-m.Timestamp < duration {
+			if r.am.fifo {
+				break
+			}
+		} else if now >= m.NotBefore {
+			return true
+		}
+	}
+	return false
+}
+
+// Oldest returns the message with the smallest timestamp, or nil if there is no message. The
+// messages are scanned only when the cached oldest message has been removed or refreshed.
+func (r *recorder[flag, val]) Oldest() *Msg[flag, val] {
+	r.rlock()
+	defer r.RUnlock()
+	if o := r.oldest.Load(); o != nil && r.msgs[o.ID] == o {
+		return o
+	}
+	var oldest *Msg[flag, val]
 	for _, m := range r.msgs {
+		if oldest == nil || m.Timestamp < oldest.Timestamp {
+			oldest = m
+		}
+	}
+	if oldest != nil {
+		r.oldest.Store(oldest)
+	}
+	return oldest
+}
+
+// Evict removes m if it is still recorded, and reports whether it is removed. Copies of m made by
+// resends count as m, while a message set again with the same id doesn't. Pinned messages are
+// kept if keepPinned is true. OnRemove is left to the caller, which knows the reason.
+func (r *recorder[flag, val]) Evict(m *Msg[flag, val], keepPinned bool) bool {
+	r.lock()
+	cur, ok := r.msgs[m.ID]
+	ok = ok && cur.serial == m.serial && !(keepPinned && cur.Pinned)
+	empty := false
+	if ok {
+		r.delete(m.ID)
+		empty = r.am.release(1)
+	}
+	r.Unlock()
+	if empty {
+		r.am.notifyEmpty()
+	}
+	return ok
+}
+
+// ForEach calls fn for each message until fn returns false, and reports whether it stopped.
+func (r *recorder[flag, val]) ForEach(fn func(*Msg[flag, val]) bool) bool {
+	r.rlock()
+	defer r.RUnlock()
+	for _, m := range r.msgs {
+		if !fn(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetByID returns a copy of the message of id.
+func (r *recorder[flag, val]) GetByID(id int64) (*Msg[flag, val], bool) {
+	r.rlock()
+	defer r.RUnlock()
+	return r.getByID(id)
+}
+
+// getByID is GetByID without locking.
+func (r *recorder[flag, val]) getByID(id int64) (*Msg[flag, val], bool) {
+	m, ok := r.msgs[id]
+	if !ok {
+		return nil, false
+	}
+	c := *m
+	return &c, true
+}
+
+// Flag returns flag of the message of id.
+func (r *recorder[flag, val]) Flag(id int64) (f flag, ok bool) {
+	r.rlock()
+	if m, found := r.msgs[id]; found {
+		f, ok = m.Flag, true
+	}
+	r.RUnlock()
+	return f, ok
+}
+
+// Value returns value of the message of id.
+func (r *recorder[flag, val]) Value(id int64) (v val, ok bool) {
+	r.rlock()
+	if m, found := r.msgs[id]; found {
+		v, ok = m.Value, true
+	}
+	r.RUnlock()
+	return v, ok
+}
+
+// GetAndRefresh appends messages have not acked after duration to dst, and refreshes their
+// timestamps to now.
+func (r *recorder[flag, val]) GetAndRefresh(duration int64, dst []*Msg[flag, val]) []*Msg[flag, val] {
+	if duration <= 0 {
+		return dst
+	}
+
+	now := r.am.now()
+	r.lock()
+	for id, m := range r.msgs {
 		if now-m.Timestamp >= duration {
-			res = append(res, m)
+			c := *m
+			c.Timestamp = now
+			r.changed(&c)
+			r.msgs[id] = &c
+			r.push(&c)
+			dst = append(dst, &c)
+		}
+	}
+	r.Unlock()
+	return dst
+}
+
+// ProcessExpired calls fn for each message have not acked after duration. The message is removed
+// if fn returns true, otherwise its timestamp is refreshed to now.
+func (r *recorder[flag, val]) ProcessExpired(duration int64, fn func(*Msg[flag, val]) bool) {
+	if duration <= 0 {
+		return
+	}
+
+	var removed []*Msg[flag, val]
+	n := 0
+	now := r.am.now()
+	r.lock()
+	for id, m := range r.msgs {
+		if now-m.Timestamp < duration {
+			continue
+		}
+		if fn(m) {
+			r.delete(id)
+			n++
+			if r.am.onRemove != nil {
+				removed = append(removed, m)
+			}
+			if r.am.latency != nil {
+				r.am.latency.observe(time.Duration(now - m.Timestamp))
+			}
+			continue
+		}
+		c := *m
+		c.Timestamp = now
+		r.changed(&c)
+		r.msgs[id] = &c
+		r.push(&c)
+	}
+	empty := n > 0 && r.am.release(n)
+	r.Unlock()
+	if empty {
+		r.am.notifyEmpty()
+	}
+	r.am.removed(RemoveAcked, removed...)
+}
+
+// GetWhere appends messages satisfying pred to dst until dst has max messages, or all of them if
+// max is 0.
+func (r *recorder[flag, val]) GetWhere(pred func(*Msg[flag, val]) bool, dst []*Msg[flag, val], max int) []*Msg[flag, val] {
+	r.rlock()
+	for _, m := range r.msgs {
+		if max > 0 && len(dst) >= max {
+			break
+		}
+		if pred(m) {
+			dst = append(dst, m)
 		}
 	}
 	r.RUnlock()
-	return res
+	return dst
 }
 
-// ReAllocate to release the map memory.
-func (r *recorder[flag, val]) ReAllocate() {
-	newMsgs := make(map[int64]*msg[flag, val], len(r.msgs))
-	r.Lock()
+// DrainTo removes all messages and calls fn for each of them.
+func (r *recorder[flag, val]) DrainTo(fn func(*Msg[flag, val])) {
+	r.lock()
+	removed, empty := r.clear(fn)
+	r.Unlock()
+	if empty {
+		r.am.notifyEmpty()
+	}
+	r.am.removed(RemoveCleared, removed...)
+}
+
+// Reset drops all messages.
+func (r *recorder[flag, val]) Reset() {
+	r.lock()
+	removed, empty := r.clear(nil)
+	r.Unlock()
+	if empty {
+		r.am.notifyEmpty()
+	}
+	r.am.removed(RemoveCleared, removed...)
+}
+
+// clear removes all messages and calls fn, if it is not nil, for each of them. It must be called
+// with the write lock held. It returns the removed messages if OnRemove is set, and reports
+// whether pending messages drop to zero.
+func (r *recorder[flag, val]) clear(fn func(*Msg[flag, val])) (removed []*Msg[flag, val], empty bool) {
+	n, bytes := 0, int64(0)
+	for id, m := range r.msgs {
+		r.deleted(id)
+		queued := r.queued[id]
+		if fn != nil {
+			fn(m)
+			for _, q := range queued {
+				fn(q)
+			}
+		}
+		if r.am.onRemove != nil {
+			removed = append(append(removed, m), queued...)
+		}
+		n += 1 + len(queued)
+		bytes += m.size
+		for _, q := range queued {
+			bytes += q.size
+		}
+	}
+	if bytes != 0 {
+		atomic.AddInt64(&r.am.bytes, -bytes)
+	}
+	r.msgs = map[int64]*Msg[flag, val]{}
+	r.fifo = nil
+	r.peak = 0
+	if r.queued != nil {
+		r.queued = map[int64][]*Msg[flag, val]{}
+	}
+	return removed, n > 0 && r.am.release(n)
+}
+
+// ReAllocate to release the map memory. Unless force is set, the map is rebuilt only if it has
+// shrunk to less than 1/reallocateRatio of its peak size, and it reports whether it's rebuilt.
+func (r *recorder[flag, val]) ReAllocate(force bool) bool {
+	r.lock()
+	defer r.Unlock()
+	if !force && r.peak <= reallocateRatio*len(r.msgs) {
+		return false
+	}
+	r.rebuild(len(r.msgs))
+	r.peak = len(r.msgs)
+	return true
+}
+
+// Prewarm rebuilds the map with room for size messages, unless it already holds that many.
+func (r *recorder[flag, val]) Prewarm(size int) {
+	r.lock()
+	defer r.Unlock()
+	if len(r.msgs) < size {
+		r.rebuild(size)
+	}
+}
+
+// rebuild copies the messages to a new map of size. It must be called with the write lock held.
+func (r *recorder[flag, val]) rebuild(size int) {
+	newMsgs := make(map[int64]*Msg[flag, val], size)
 	for k, v := range r.msgs {
 		newMsgs[k] = v
 	}
 	r.msgs = newMsgs
-	r.RUnlock()
 }
@@ -0,0 +1,266 @@
+package ack
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestMultiFlag(t *testing.T) {
+	removed := 0
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:  2,
+		MultiFlag: true,
+		OnRemove:  func(m *Msg[int, string], reason RemoveReason) { removed++ },
+	})
+	for f := 1; f <= 3; f++ {
+		a.Set(1, f, "v")
+	}
+	held, _ := a.GetByID(1)
+	a.Ack(1, 2)
+	a.Ack(1, 4)
+	m, ok := a.GetByID(1)
+	if !ok || !slices.Equal(m.Parts, []int{1, 3}) {
+		t.Fatalf("parts after a partial ack = %v, %v, want [1 3]", m, ok)
+	}
+	if !slices.Equal(held.Parts, []int{1, 2, 3}) {
+		t.Fatalf("parts of a message held before the ack changed to %v", held.Parts)
+	}
+	a.Ack(1, 1)
+	if a.Len() != 1 || removed != 0 {
+		t.Fatalf("Len = %d with %d removed before the last part is acked, want 1 with none removed",
+			a.Len(), removed)
+	}
+	a.Ack(1, 3)
+	if a.Len() != 0 || removed != 1 {
+		t.Fatalf("Len = %d with %d removed after all parts are acked, want 0 with one removed", a.Len(), removed)
+	}
+}
+
+func TestMultiFlagCanAck(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2, MultiFlag: true, CanAck: LessOrEqual[int]()})
+	a.Set(1, 5, "v")
+	a.Set(1, 1, "v")
+	// the first part acked by the flag is removed, not all of them.
+	a.Ack(1, 9)
+	if m, _ := a.GetByID(1); !slices.Equal(m.Parts, []int{1}) {
+		t.Fatalf("parts = %v, want [1]", m.Parts)
+	}
+	a.Ack(1, 0)
+	a.Ack(1, 1)
+	if a.Len() != 0 {
+		t.Fatalf("Len = %d after all parts are acked, want 0", a.Len())
+	}
+}
+
+func TestReAllocateSkipsStableSegments(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2})
+	for id := int64(0); id < 200; id++ {
+		a.Set(id, 0, "v")
+	}
+	// even ids are in segment 0, which shrinks, and odd ids in segment 1, which doesn't.
+	for id := int64(0); id < 180; id += 2 {
+		a.Ack(id, 0)
+	}
+	maps := func() [2]unsafe.Pointer {
+		return [2]unsafe.Pointer{reflect.ValueOf(a.records[0].msgs).UnsafePointer(),
+			reflect.ValueOf(a.records[1].msgs).UnsafePointer()}
+	}
+	before := maps()
+	a.ReAllocate()
+	after := maps()
+	if after[0] == before[0] {
+		t.Error("the map of the shrunk segment is not rebuilt")
+	}
+	if after[1] != before[1] {
+		t.Error("the map of the stable segment is rebuilt")
+	}
+	if a.Len() != 110 {
+		t.Fatalf("Len = %d after ReAllocate, want 110", a.Len())
+	}
+
+	// the rebuilt segment is stable now.
+	a.ReAllocate()
+	if maps() != after {
+		t.Error("a map is rebuilt again without shrinking")
+	}
+	a.ReAllocateForce()
+	if now := maps(); now[0] == after[0] || now[1] == after[1] {
+		t.Error("ReAllocateForce skipped a segment")
+	}
+}
+
+func TestLockPlain(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2, LockKind: LockPlain})
+	for id := int64(0); id < 10; id++ {
+		a.Set(id, 0, "v")
+	}
+	a.Ack(3, 0)
+	if got := a.GetWhere(func(m *Msg[int, string]) bool { return m.ID < 5 }); len(got) != 4 {
+		t.Fatalf("GetWhere = %v, want 4 messages", got)
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkLockKind sets and acks messages from parallel goroutines, a write-heavy workload
+// calling Get once every 100 operations, with both kinds of segment locks.
+func BenchmarkLockKind(b *testing.B) {
+	for _, bb := range []struct {
+		name string
+		kind LockKind
+	}{{"rw", LockRW}, {"plain", LockPlain}} {
+		b.Run(bb.name, func(b *testing.B) {
+			a, _ := NewAckManager(&Config[int64, int64]{Capacity: 16, LockKind: bb.kind})
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				id := next.Add(1 << 32)
+				for i := 0; pb.Next(); i++ {
+					a.Set(id+int64(i), 0, 0)
+					a.Ack(id+int64(i), 0)
+					if i%100 == 0 {
+						a.Get(int64(time.Hour))
+					}
+				}
+			})
+		})
+	}
+}
+
+// values returns the values of msgs sorted by id, then by value.
+func values[flag any](msgs []*Msg[flag, string]) []string {
+	slices.SortFunc(msgs, func(a, b *Msg[flag, string]) int {
+		if a.ID != b.ID {
+			return int(a.ID - b.ID)
+		}
+		return strings.Compare(a.Value, b.Value)
+	})
+	res := make([]string, len(msgs))
+	for i, m := range msgs {
+		res[i] = m.Value
+	}
+	return res
+}
+
+func TestOrderedPerKey(t *testing.T) {
+	clock := newFakeClock()
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:      2,
+		OrderedPerKey: true,
+		Now:           clock.Now,
+		SizeOf:        func(v string) int { return len(v) },
+	})
+	for _, v := range []string{"a", "bb", "ccc"} {
+		a.Set(1, 0, v)
+		clock.Add(time.Second)
+	}
+	a.Set(2, 0, "d")
+	clock.Add(time.Minute)
+
+	check := func(wantLen int, wantBytes int64) {
+		t.Helper()
+		if a.Len() != wantLen || a.ApproxBytes() != wantBytes {
+			t.Fatalf("Len, ApproxBytes = %d, %d, want %d, %d", a.Len(), a.ApproxBytes(), wantLen, wantBytes)
+		}
+		if err := a.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(4, 7)
+	if got := values(a.Get(1)); !slices.Equal(got, []string{"a", "d"}) {
+		t.Fatalf("Get = %v, want only the heads [a d]", got)
+	}
+
+	for _, want := range []string{"bb", "ccc"} {
+		a.Ack(1, 0)
+		if m, ok := a.GetByID(1); !ok || m.Value != want {
+			t.Fatalf("head after an ack = %v, %v, want %s", m, ok, want)
+		}
+		if got := values(a.Get(1)); !slices.Contains(got, want) {
+			t.Fatalf("Get after an ack = %v, want the promoted %s", got, want)
+		}
+	}
+	check(2, 4)
+	a.Ack(1, 0)
+	if _, ok := a.GetByID(1); ok {
+		t.Fatal("id 1 is pending after its whole sequence is acked")
+	}
+	check(1, 1)
+}
+
+func TestOrderedPerKeyMoves(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 3, OrderedPerKey: true})
+	for id := range int64(10) {
+		for _, v := range []string{"a", "b", "c"} {
+			a.Set(id, 0, v)
+		}
+	}
+	if !a.Rekey(3, 100) {
+		t.Fatal("Rekey of a queued id failed")
+	}
+	if err := a.Resize(7); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{0, 5, 100} {
+		for _, want := range []string{"a", "b", "c"} {
+			if m, ok := a.GetByID(id); !ok || m.Value != want {
+				t.Fatalf("head of id %d = %v, %v, want %s", id, m, ok, want)
+			}
+			a.Ack(id, 0)
+		}
+	}
+	if a.Len() != 21 {
+		t.Fatalf("Len = %d, want 21", a.Len())
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	a.Reset()
+	if a.Len() != 0 {
+		t.Fatalf("Len after Reset = %d, want 0", a.Len())
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractWhereOrderedPerKey(t *testing.T) {
+	cfg := &Config[int, string]{Capacity: 4, OrderedPerKey: true}
+	a, _ := NewAckManager(cfg)
+	for id := range int64(20) {
+		a.Set(id, 0, "first")
+		a.Set(id, 0, "second")
+	}
+	extracted := a.ExtractWhere(func(m *Msg[int, string]) bool { return m.ID%2 == 0 })
+	if len(extracted) != 20 || a.Len() != 20 {
+		t.Fatalf("extracted %d with %d left, want 20 and 20", len(extracted), a.Len())
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for id := int64(0); id < 20; id += 2 {
+		if _, ok := a.GetByID(id); ok {
+			t.Fatalf("id %d is still pending after its extraction", id)
+		}
+	}
+
+	b, _ := NewAckManager(cfg)
+	b.Restore(extracted)
+	for _, want := range []string{"first", "second"} {
+		if m, ok := b.GetByID(4); !ok || m.Value != want {
+			t.Fatalf("head of a restored id = %v, %v, want %s", m, ok, want)
+		}
+		b.Ack(4, 0)
+	}
+	if b.Len() != 18 {
+		t.Fatalf("Len after restoring = %d, want 18", b.Len())
+	}
+}
@@ -0,0 +1,48 @@
+package ack
+
+// RemoveReason is the reason a message is removed, passed to OnRemove.
+type RemoveReason int
+
+const (
+	// RemoveAcked is a message acked by Ack, AckBefore, AckRange or ProcessExpired.
+	RemoveAcked RemoveReason = iota
+	// RemoveDeadLettered is a message dead-lettered by the sweeper, after MaxRetries resends or
+	// MaxAge.
+	RemoveDeadLettered
+	// RemoveEvicted is a message evicted by MaxTotal.
+	RemoveEvicted
+	// RemoveCanceled is a message removed because the context of SetWithContext is done.
+	RemoveCanceled
+	// RemoveExtracted is a message taken out by ExtractWhere.
+	RemoveExtracted
+	// RemoveCleared is a message dropped by Reset or DrainTo.
+	RemoveCleared
+)
+
+func (r RemoveReason) String() string {
+	switch r {
+	case RemoveAcked:
+		return "acked"
+	case RemoveDeadLettered:
+		return "dead-lettered"
+	case RemoveEvicted:
+		return "evicted"
+	case RemoveCanceled:
+		return "canceled"
+	case RemoveExtracted:
+		return "extracted"
+	case RemoveCleared:
+		return "cleared"
+	}
+	return "unknown"
+}
+
+// removed calls onRemove for each of msgs. It must be called outside the segment lock.
+func (a *AckManager[flag, val]) removed(reason RemoveReason, msgs ...*Msg[flag, val]) {
+	if a.onRemove == nil {
+		return
+	}
+	for _, m := range msgs {
+		a.onRemove(m, reason)
+	}
+}
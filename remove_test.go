@@ -0,0 +1,104 @@
+package ack
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOnRemove(t *testing.T) {
+	clock := newFakeClock()
+	var mu sync.Mutex
+	reasons := map[int64][]RemoveReason{}
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:   4,
+		Now:        clock.Now,
+		MaxRetries: 1,
+		MaxTotal:   20,
+		OnRemove: func(m *Msg[int, string], reason RemoveReason) {
+			mu.Lock()
+			reasons[m.ID] = append(reasons[m.ID], reason)
+			mu.Unlock()
+		},
+	})
+	set := func(ids ...int64) {
+		for _, id := range ids {
+			a.Set(id, 0, "v")
+		}
+	}
+	want := map[int64]RemoveReason{}
+	expect := func(reason RemoveReason, ids ...int64) {
+		for _, id := range ids {
+			want[id] = reason
+		}
+	}
+
+	set(1, 2, 3, 4)
+	a.Set(1, 0, "overwritten, not removed")
+	a.Ack(1, 0)
+	a.AckRange(2, 3, 0)
+	a.CompareAndAck(4, 0, nil)
+	expect(RemoveAcked, 1, 2, 3, 4)
+
+	set(5)
+	clock.Add(time.Second)
+	set(6)
+	a.AckBefore(clock.Now().UnixNano(), 0)
+	expect(RemoveAcked, 5)
+	clock.Add(time.Second)
+	a.ProcessExpired(int64(time.Second), func(*Msg[int, string]) bool { return true })
+	expect(RemoveAcked, 6)
+
+	set(7)
+	clock.Add(time.Second)
+	a.SweepOnce(1)
+	clock.Add(time.Second)
+	a.SweepOnce(1)
+	expect(RemoveDeadLettered, 7)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.SetWithContext(ctx, 8, 0, "v")
+	cancel()
+	waitFor(t, "message 8 canceled", func() bool {
+		_, ok := a.GetByID(8)
+		return !ok
+	})
+	expect(RemoveCanceled, 8)
+
+	set(9, 10)
+	a.ExtractWhere(func(m *Msg[int, string]) bool { return m.ID == 9 })
+	expect(RemoveExtracted, 9)
+	a.DrainTo(func(*Msg[int, string]) {})
+	expect(RemoveCleared, 10)
+	set(11)
+	a.Reset()
+	expect(RemoveCleared, 11)
+
+	for id := int64(100); id < 121; id++ {
+		set(id)
+		clock.Add(time.Second)
+	}
+	// the evicted message is about the oldest one, see MaxTotal.
+	for id := int64(100); id < 121; id++ {
+		if _, ok := a.GetByID(id); !ok {
+			expect(RemoveEvicted, id)
+		}
+	}
+	if a.Len() != 20 {
+		t.Fatalf("Len = %d, want MaxTotal", a.Len())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for id, reason := range want {
+		if got := reasons[id]; len(got) != 1 || got[0] != reason {
+			t.Errorf("OnRemove of message %d got %v, want %v once", id, got, reason)
+		}
+	}
+	for id, got := range reasons {
+		if _, ok := want[id]; !ok {
+			t.Errorf("OnRemove of message %d got %v, want nothing", id, got)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package ack
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+)
+
+// ring is a consistent hashing ring of segments. Each segment owns replicas points on the ring and
+// a key belongs to the segment owning the first point after its hash. When the number of segments
+// changes, only keys around the points of added or removed segments move.
+type ring struct {
+	points   []uint64
+	segments []int // segment index of each point
+}
+
+func newRing(capacity, replicas int) *ring {
+	r := &ring{
+		points:   make([]uint64, 0, capacity*replicas),
+		segments: make([]int, 0, capacity*replicas),
+	}
+	type point struct {
+		hash    uint64
+		segment int
+	}
+	points := make([]point, 0, capacity*replicas)
+	for i := 0; i < capacity; i++ {
+		for j := 0; j < replicas; j++ {
+			points = append(points, point{hash: mix(uint64(i)<<32 | uint64(j)), segment: i})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.segments = append(r.segments, p.segment)
+	}
+	return r
+}
+
+// get returns the segment index of the key hash.
+func (r *ring) get(h uint64) int {
+	h = mix(h)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.segments[i]
+}
+
+// mix scatters h by the splitmix64 finalizer, so that sequential ids don't gather in an arc.
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// Resize changes the number of segments to capacity and moves messages to their new segments.
+// With ConsistentHashing only a fraction of messages is moved, otherwise almost all of them are.
+// It fails with ErrRunning if the daemon goroutine is running, and it must not be called
+// concurrently with other methods.
+func (a *AckManager[flag, val]) Resize(capacity int) error {
+	if capacity <= 0 {
+		return errors.New("capacity should be more than 0")
+	}
+	if atomic.LoadInt32(&a.status) != stopped {
+		return ErrRunning
+	}
+
+	old := a.records
+	a.records = make([]*recorder[flag, val], capacity)
+	for i := range a.records {
+		if i < len(old) {
+			a.records[i] = old[i]
+		} else {
+			a.records[i] = newRecorder[flag, val](a)
+		}
+	}
+	a.capacity = capacity
+	if a.ring != nil {
+		a.ring = newRing(capacity, a.replicas)
+	}
+
+	for _, r := range old {
+		for id, m := range r.msgs {
+			if to := a.segment(id); to != r {
+				delete(r.msgs, id)
+				to.msgs[id] = m
+				to.oldest.Store(nil)
+				if queued, ok := r.queued[id]; ok {
+					delete(r.queued, id)
+					to.queued[id] = queued
+				}
+			}
+		}
+	}
+	for _, r := range old {
+		for id, v := range r.tombstones {
+			if to := a.segment(id); to != r {
+				delete(r.tombstones, id)
+				to.tombstones[id] = v
+			}
+		}
+	}
+	if a.fifo {
+		for _, r := range a.records {
+			r.rebuildFIFO()
+		}
+	}
+	return nil
+}
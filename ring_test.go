@@ -0,0 +1,80 @@
+package ack
+
+import (
+	"testing"
+)
+
+// moved returns the fraction of ids in [0, n) whose segment changes when a manager configured by
+// cfg is resized from 16 to 17 segments.
+func moved(cfg *Config[int, string], n int) float64 {
+	cfg.Capacity = 16
+	a, _ := NewAckManager(cfg)
+	before := make([]int, n)
+	for id := range before {
+		before[id] = a.index(int64(id))
+	}
+	a.Resize(17)
+	count := 0
+	for id, i := range before {
+		if a.index(int64(id)) != i {
+			count++
+		}
+	}
+	return float64(count) / float64(n)
+}
+
+func TestResize(t *testing.T) {
+	for _, consistent := range []bool{false, true} {
+		a, _ := NewAckManager(&Config[int, string]{Capacity: 4, ConsistentHashing: consistent, TrackChanges: true})
+		for id := int64(0); id < 100; id++ {
+			a.Set(id, 0, "v")
+		}
+		for id := int64(0); id < 100; id += 2 {
+			a.Ack(id, 0)
+		}
+		if err := a.Resize(7); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Verify(); err != nil {
+			t.Fatalf("ConsistentHashing %v: %v", consistent, err)
+		}
+		for id := int64(1); id < 100; id += 2 {
+			if _, ok := a.GetByID(id); !ok {
+				t.Fatalf("ConsistentHashing %v: message %d lost by Resize", consistent, id)
+			}
+		}
+		if _, removed, _, _ := a.SnapshotSince(1); len(removed) != 50 {
+			t.Fatalf("ConsistentHashing %v: %d tombstones after Resize, want 50", consistent, len(removed))
+		}
+	}
+}
+
+func TestConsistentHashingMovesFewKeys(t *testing.T) {
+	if f := moved(&Config[int, string]{ConsistentHashing: true}, 100_000); f > 0.15 {
+		t.Fatalf("ConsistentHashing moved %.2f of keys from 16 to 17 segments, want about 1/17", f)
+	}
+	if f := moved(&Config[int, string]{}, 100_000); f < 0.5 {
+		t.Fatalf("modulo moved %.2f of keys from 16 to 17 segments, want most of them", f)
+	}
+}
+
+// BenchmarkResizeMoved reports the fraction of keys moved from 16 to 17 segments by modulo and
+// by ConsistentHashing.
+func BenchmarkResizeMoved(b *testing.B) {
+	for _, bb := range []struct {
+		name string
+		cfg  Config[int, string]
+	}{
+		{"modulo", Config[int, string]{}},
+		{"consistent", Config[int, string]{ConsistentHashing: true}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			var f float64
+			for b.Loop() {
+				cfg := bb.cfg
+				f = moved(&cfg, 10_000)
+			}
+			b.ReportMetric(f, "moved/key")
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package ack
+
+import "slices"
+
+// LockSegments write-locks the segments of ids and returns the function unlocking them. It is an
+// advanced primitive for consistent reads across ids, e.g. with GetLocked, while no other
+// goroutine modifies them. Segments are locked in ascending index order, which is the same for
+// every caller, so concurrent LockSegments calls never deadlock each other. Other methods of the
+// ack manager touching the locked segments must not be called until unlock, or they deadlock.
+func (a *AckManager[flag, val]) LockSegments(ids ...int64) (unlock func()) {
+	indexes := make([]int, 0, len(ids))
+	for _, id := range ids {
+		indexes = append(indexes, a.index(a.canonical(id)))
+	}
+	slices.Sort(indexes)
+	indexes = slices.Compact(indexes)
+	for _, i := range indexes {
+		a.records[i].lock()
+	}
+	return func() {
+		for _, i := range slices.Backward(indexes) {
+			a.records[i].Unlock()
+		}
+	}
+}
+
+// GetLocked is like GetByID but doesn't lock. It must only be called for ids whose segments are
+// locked by LockSegments.
+func (a *AckManager[flag, val]) GetLocked(id int64) (*Msg[flag, val], bool) {
+	id = a.canonical(id)
+	return a.segment(id).getByID(id)
+}
+
+// Rekey moves the pending message of oldID to newID, keeping its Timestamp and Retries, e.g. when
+// a temporary id is replaced by a permanent one. It reports whether it is moved, that is oldID
+// is pending and newID is not. In OrderedPerKey mode the queued messages move with it. Like Set,
+// it forgets a recent ack of newID, see RecentAcks.
+func (a *AckManager[flag, val]) Rekey(oldID, newID int64) bool {
+	oldID, newID = a.canonical(oldID), a.canonical(newID)
+	if oldID == newID {
+		return false
+	}
+	unlock := a.LockSegments(oldID, newID)
+	defer unlock()
+
+	from, to := a.segment(oldID), a.segment(newID)
+	m, ok := from.msgs[oldID]
+	if !ok {
+		return false
+	}
+	if _, ok := to.msgs[newID]; ok {
+		return false
+	}
+	rekey := func(m *Msg[flag, val]) *Msg[flag, val] {
+		c := *m
+		c.ID = newID
+		return &c
+	}
+	if a.recentAcks != nil {
+		a.recentAcks.Remove(newID)
+	}
+	delete(from.msgs, oldID)
+	from.deleted(oldID)
+	c := rekey(m)
+	to.changed(c)
+	to.msgs[newID] = c
+	to.older(c)
+	to.push(c)
+	to.peak = max(to.peak, len(to.msgs))
+	if queued, ok := from.queued[oldID]; ok {
+		delete(from.queued, oldID)
+		moved := make([]*Msg[flag, val], len(queued))
+		for i, q := range queued {
+			moved[i] = rekey(q)
+		}
+		to.queued[newID] = moved
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package ack
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRekey(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		oldID, newID int64
+	}{
+		{"same segment", 1, 5},
+		{"cross segment", 1, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			am, err := NewAckManager(&Config[int64, string]{Capacity: 4, CanAck: LessOrEqual[int64]()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if same := am.index(tc.oldID) == am.index(tc.newID); same != (tc.name == "same segment") {
+				t.Fatalf("ids %d and %d in the same segment: %v", tc.oldID, tc.newID, same)
+			}
+			am.Set(tc.oldID, 3, "v")
+			before, _ := am.GetByID(tc.oldID)
+			if !am.Rekey(tc.oldID, tc.newID) {
+				t.Fatal("Rekey = false, want true")
+			}
+			if _, ok := am.GetByID(tc.oldID); ok {
+				t.Fatal("old id still pending")
+			}
+			after, ok := am.GetByID(tc.newID)
+			if !ok || after.Value != "v" || after.Timestamp != before.Timestamp || after.Flag != 3 {
+				t.Fatalf("GetByID(new) = %+v, %v, want the moved message", after, ok)
+			}
+			if am.Len() != 1 {
+				t.Fatalf("Len = %d, want 1", am.Len())
+			}
+			am.Ack(tc.newID, 3)
+			if am.Len() != 0 {
+				t.Fatalf("Len = %d after ack, want 0", am.Len())
+			}
+		})
+	}
+}
+
+func TestRekeyRefused(t *testing.T) {
+	am, err := NewAckManager(&Config[int64, string]{Capacity: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	am.Set(1, 0, "a")
+	am.Set(2, 0, "b")
+	if am.Rekey(1, 2) {
+		t.Fatal("Rekey onto a pending id = true, want false")
+	}
+	if am.Rekey(3, 4) {
+		t.Fatal("Rekey of an id not pending = true, want false")
+	}
+	if am.Rekey(1, 1) {
+		t.Fatal("Rekey onto itself = true, want false")
+	}
+	if v, _ := am.Value(2); v != "b" {
+		t.Fatalf("Value(2) = %q, want b", v)
+	}
+}
+
+func TestRekeyOntoRecentlyAckedID(t *testing.T) {
+	am, err := NewAckManager(&Config[int64, int]{Capacity: 4, RecentAcks: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	am.Set(2, 0, 0)
+	am.Ack(2, 0)
+	am.Set(1, 0, 0)
+	if !am.Rekey(1, 2) {
+		t.Fatal("Rekey = false, want true")
+	}
+	am.Ack(2, 0)
+	if am.Len() != 0 {
+		t.Fatalf("Len = %d, want 0", am.Len())
+	}
+	if d := am.Stats().DuplicateAcks; d != 0 {
+		t.Fatalf("DuplicateAcks = %d, want 0", d)
+	}
+}
+
+func TestLockSegments(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 4})
+	a.Set(1, 0, "a")
+	a.Set(2, 0, "b")
+
+	unlock := a.LockSegments(1, 2)
+	set := make(chan struct{})
+	go func() {
+		a.Set(1, 0, "c")
+		close(set)
+	}()
+	select {
+	case <-set:
+		t.Fatal("Set didn't wait for the locked segment")
+	case <-time.After(10 * time.Millisecond):
+	}
+	m1, ok1 := a.GetLocked(1)
+	m2, ok2 := a.GetLocked(2)
+	if !ok1 || !ok2 || m1.Value != "a" || m2.Value != "b" {
+		t.Fatalf("GetLocked = %v, %v, want the messages before the Set", m1, m2)
+	}
+	unlock()
+	<-set
+	if v, _ := a.Value(1); v != "c" {
+		t.Fatalf("Value(1) = %q after unlock, want c", v)
+	}
+
+	// opposite orders of ids don't deadlock, and ids of one segment lock it once.
+	var wg sync.WaitGroup
+	for _, ids := range [][]int64{{1, 2}, {2, 1}, {1, 5, 1}} {
+		wg.Go(func() {
+			for range 1000 {
+				a.LockSegments(ids...)()
+			}
+		})
+	}
+	wg.Wait()
+}
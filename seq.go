@@ -0,0 +1,39 @@
+package ack
+
+import "errors"
+
+// SeqManager is an ack manager of messages flagged by monotonically increasing sequences per id,
+// where the latest message wins: a pending message is only replaced by one with a higher or
+// equal sequence, and acked by an ack with a sequence not less than its own. It's the wallet
+// balance case in the comment of Config field CanAck.
+type SeqManager[val any] struct {
+	*AckManager[uint64, val]
+}
+
+// NewSeqManager creates a SeqManager. CanAck of cfg is ignored, and cfg must not set MultiFlag
+// or OrderedPerKey.
+func NewSeqManager[val any](cfg *Config[uint64, val]) (*SeqManager[val], error) {
+	if cfg.MultiFlag || cfg.OrderedPerKey {
+		return nil, errors.New("MultiFlag and OrderedPerKey can't be used with sequences")
+	}
+	c := *cfg
+	c.CanAck = LessOrEqual[uint64]()
+	am, err := NewAckManager(&c)
+	if err != nil {
+		return nil, err
+	}
+	am.keepOld = func(old, new uint64) bool {
+		return new < old
+	}
+	return &SeqManager[val]{AckManager: am}, nil
+}
+
+// SetSeq records v with sequence seq, unless a message of id with a higher sequence is pending.
+func (s *SeqManager[val]) SetSeq(id int64, seq uint64, v val) error {
+	return s.Set(id, seq, v)
+}
+
+// AckSeq acks the message of id if its sequence is not higher than seq.
+func (s *SeqManager[val]) AckSeq(id int64, seq uint64) error {
+	return s.Ack(id, seq)
+}
@@ -0,0 +1,53 @@
+package ack
+
+import "testing"
+
+func TestSeqManagerOutOfOrder(t *testing.T) {
+	sm, err := NewSeqManager(&Config[uint64, string]{Capacity: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.SetSeq(1, 5, "five")
+	sm.SetSeq(1, 3, "three") // stale, kept out
+	if v, _ := sm.Value(1); v != "five" {
+		t.Fatalf("Value = %q, want five", v)
+	}
+	sm.SetSeq(1, 7, "seven")
+	if v, _ := sm.Value(1); v != "seven" {
+		t.Fatalf("Value = %q, want seven", v)
+	}
+	sm.AckSeq(1, 6) // ack of an older sequence
+	if sm.Len() != 1 {
+		t.Fatalf("Len = %d after stale ack, want 1", sm.Len())
+	}
+	sm.AckSeq(1, 8)
+	if sm.Len() != 0 {
+		t.Fatalf("Len = %d, want 0", sm.Len())
+	}
+}
+
+func TestSeqManagerStaleSetHasNoSideEffects(t *testing.T) {
+	sets := 0
+	sm, err := NewSeqManager(&Config[uint64, string]{
+		Capacity: 2,
+		TraceOps: 10,
+		OnSet:    func(*Msg[uint64, string]) { sets++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.SetSeq(1, 5, "five")
+	if overwritten, _ := sm.SetResult(1, 3, "three"); overwritten {
+		t.Fatal("SetResult of a stale sequence reports an overwrite")
+	}
+	if sets != 1 {
+		t.Fatalf("OnSet called %d times, want 1", sets)
+	}
+	ops := sm.RecentOps()
+	if last := ops[len(ops)-1]; last.Outcome != OpKept {
+		t.Fatalf("last op outcome = %v, want %v", last.Outcome, OpKept)
+	}
+	if v, _ := sm.Value(1); v != "five" {
+		t.Fatalf("Value = %q, want five", v)
+	}
+}
@@ -0,0 +1,21 @@
+package ack
+
+// SimpleManager is an ack manager of string values flagged by int64 timestamps or versions, for
+// users who don't need the generic AckManager. Messages are acked by flags not less than the one
+// they were set with.
+type SimpleManager struct {
+	*AckManager[int64, string]
+}
+
+// NewSimpleManager creates a SimpleManager of capacity segments, async if async is true.
+func NewSimpleManager(capacity int, async bool) (*SimpleManager, error) {
+	am, err := NewAckManager(&Config[int64, string]{
+		Capacity: capacity,
+		Async:    async,
+		CanAck:   LessOrEqual[int64](),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SimpleManager{AckManager: am}, nil
+}
@@ -0,0 +1,101 @@
+package ack
+
+import "sync/atomic"
+
+// Stats is a snapshot of the ack manager counters.
+type Stats struct {
+	// Contention is the number of contended lock acquisitions of each segment. It is only
+	// collected when TrackContention is set in Config.
+	Contention []int64
+	// DroppedSets and DroppedAcks are the number of messages dropped because the async buffer
+	// is full.
+	DroppedSets int64
+	DroppedAcks int64
+	// ProcessedSets and ProcessedAcks are the number of buffered messages processed in async mode.
+	ProcessedSets int64
+	ProcessedAcks int64
+	// Retries is the number of messages resent by the sweeper.
+	Retries int64
+	// DuplicateAcks is the number of duplicate acks detected when RecentAcks is set.
+	DuplicateAcks int64
+	// RejectedAcks is the number of acks of pending messages rejected by CanAck, which usually
+	// means that flags are misconfigured. Acks by AckBefore and AckRange are not counted.
+	RejectedAcks int64
+}
+
+// Stats returns current counters of the ack manager.
+func (a *AckManager[flag, val]) Stats() Stats {
+	s := Stats{
+		Contention:  make([]int64, len(a.records)),
+		DroppedSets: atomic.LoadInt64(&a.droppedSets),
+		DroppedAcks: atomic.LoadInt64(&a.droppedAcks),
+
+		ProcessedSets: atomic.LoadInt64(&a.processedSets),
+		ProcessedAcks: atomic.LoadInt64(&a.processedAcks),
+		Retries:       atomic.LoadInt64(&a.retries),
+		DuplicateAcks: atomic.LoadInt64(&a.duplicateAcks),
+		RejectedAcks:  atomic.LoadInt64(&a.rejectedAcks),
+	}
+	for i, r := range a.records {
+		s.Contention[i] = atomic.LoadInt64(&r.contended)
+	}
+	return s
+}
+
+// SegmentAccess is the number of operations on a segment.
+type SegmentAccess struct {
+	Sets, Acks, Gets int64
+}
+
+// AccessStats returns the number of Set, Ack and Get operations on each segment, which shows how
+// evenly traffic is spread over segments, unlike the number of pending messages. It is only
+// collected when TrackAccess is set in Config.
+func (a *AckManager[flag, val]) AccessStats() []SegmentAccess {
+	res := make([]SegmentAccess, len(a.records))
+	for i, r := range a.records {
+		res[i] = SegmentAccess{
+			Sets: atomic.LoadInt64(&r.sets),
+			Acks: atomic.LoadInt64(&r.acks),
+			Gets: atomic.LoadInt64(&r.gets),
+		}
+	}
+	return res
+}
+
+// ResetStats zeroes the cumulative counters without touching pending messages, e.g. after they are
+// exported by a delta-based metrics exporter. It is safe to call concurrently with other methods,
+// increments racing with it are either kept or cleared.
+func (a *AckManager[flag, val]) ResetStats() {
+	for _, r := range a.records {
+		atomic.StoreInt64(&r.contended, 0)
+		atomic.StoreInt64(&r.sets, 0)
+		atomic.StoreInt64(&r.acks, 0)
+		atomic.StoreInt64(&r.gets, 0)
+	}
+	atomic.StoreInt64(&a.droppedSets, 0)
+	atomic.StoreInt64(&a.droppedAcks, 0)
+	atomic.StoreInt64(&a.processedSets, 0)
+	atomic.StoreInt64(&a.processedAcks, 0)
+	atomic.StoreInt64(&a.retries, 0)
+	atomic.StoreInt64(&a.duplicateAcks, 0)
+	atomic.StoreInt64(&a.rejectedAcks, 0)
+	if a.latency != nil {
+		a.latency.reset()
+	}
+}
+
+// errBox wraps errors of different types to be stored in an atomic.Value.
+type errBox struct {
+	err error
+}
+
+// LastError returns the latest error returned to the background goroutines, like an error of
+// Resend, or nil if there is none. It gives a quick health signal beyond liveness.
+func (a *AckManager[flag, val]) LastError() error {
+	b, _ := a.lastErr.Load().(errBox)
+	return b.err
+}
+
+func (a *AckManager[flag, val]) setLastError(err error) {
+	a.lastErr.Store(errBox{err: err})
+}
@@ -0,0 +1,143 @@
+package ack
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDroppedCounts(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:       2,
+		Async:          true,
+		SetBufferSize:  1,
+		AckBufferSize:  1,
+		OverflowPolicy: OverflowError,
+	})
+	a.Set(1, 0, "v")
+	for id := int64(2); id <= 4; id++ {
+		if err := a.Set(id, 0, "v"); !errors.Is(err, ErrMsgRecordFailed) {
+			t.Fatalf("Set on a full buffer = %v, want %v", err, ErrMsgRecordFailed)
+		}
+	}
+	a.Ack(1, 0)
+	if err := a.Ack(2, 0); !errors.Is(err, ErrMsgAckFailed) {
+		t.Fatalf("Ack on a full buffer = %v, want %v", err, ErrMsgAckFailed)
+	}
+	if s := a.Stats(); s.DroppedSets != 3 || s.DroppedAcks != 1 {
+		t.Fatalf("DroppedSets, DroppedAcks = %d, %d, want 3, 1", s.DroppedSets, s.DroppedAcks)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	clock := newFakeClock()
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:       2,
+		Async:          true,
+		SetBufferSize:  2,
+		AckBufferSize:  2,
+		OverflowPolicy: OverflowError,
+		CanAck:         LessOrEqual[int](),
+		RecentAcks:     4,
+		TrackAccess:    true,
+		LatencyBuckets: []time.Duration{time.Second},
+		Now:            clock.Now,
+	})
+	a.Set(1, 0, "v")
+	a.Set(2, 0, "v")
+	a.Set(3, 0, "v")
+	a.DrainSetCh()
+	a.Ack(1, 0)
+	a.Ack(2, -1)
+	a.DrainAckCh()
+	a.Ack(1, 0)
+	a.DrainAckCh()
+	clock.Add(time.Second)
+	a.SweepOnce(1)
+	s := a.Stats()
+	if s.DroppedSets == 0 || s.ProcessedSets == 0 || s.ProcessedAcks == 0 || s.Retries == 0 ||
+		s.DuplicateAcks == 0 || s.RejectedAcks == 0 {
+		t.Fatalf("Stats = %+v, want every counter to count", s)
+	}
+
+	a.ResetStats()
+	if s := a.Stats(); s.DroppedSets != 0 || s.DroppedAcks != 0 || s.ProcessedSets != 0 ||
+		s.ProcessedAcks != 0 || s.Retries != 0 || s.DuplicateAcks != 0 || s.RejectedAcks != 0 {
+		t.Fatalf("Stats = %+v after ResetStats, want zeros", s)
+	}
+	for i, access := range a.AccessStats() {
+		if access != (SegmentAccess{}) {
+			t.Fatalf("AccessStats of segment %d = %+v after ResetStats, want zeros", i, access)
+		}
+	}
+	for _, b := range a.LatencyHistogram() {
+		if b.Count != 0 {
+			t.Fatalf("LatencyHistogram = %v after ResetStats, want zeros", a.LatencyHistogram())
+		}
+	}
+	if a.Len() != 1 {
+		t.Fatalf("Len = %d after ResetStats, want the pending message kept", a.Len())
+	}
+}
+
+func TestLastError(t *testing.T) {
+	errDown := errors.New("downstream is down")
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:      2,
+		SweepInterval: time.Millisecond,
+		Timeout:       time.Millisecond,
+		Resend:        func(m *Msg[int, string]) error { return errDown },
+	})
+	if err := a.LastError(); err != nil {
+		t.Fatalf("LastError = %v before any resend, want nil", err)
+	}
+	a.Set(1, 0, "v")
+	a.Start()
+	defer a.Stop()
+	// read concurrently with the sweeper storing it.
+	waitFor(t, "resend error", func() bool { return a.LastError() == errDown })
+}
+
+func TestOnOverflow(t *testing.T) {
+	var dropped []*Msg[int, string]
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:       2,
+		Async:          true,
+		SetBufferSize:  1,
+		AckBufferSize:  1,
+		OverflowPolicy: OverflowError,
+		OnOverflow:     func(m *Msg[int, string]) { dropped = append(dropped, m) },
+	})
+	a.Set(1, 0, "one")
+	a.Set(2, 5, "two")
+	a.Ack(1, 0)
+	a.TryAck(3, 7)
+	if len(dropped) != 2 {
+		t.Fatalf("OnOverflow got %d messages, want 2", len(dropped))
+	}
+	if m := dropped[0]; m.isAck || m.ID != 2 || m.Flag != 5 || m.Value != "two" {
+		t.Fatalf("OnOverflow got %+v, want the set of 2", *m)
+	}
+	if m := dropped[1]; !m.isAck || m.ID != 3 || m.Flag != 7 {
+		t.Fatalf("OnOverflow got %+v, want the ack of 3", *m)
+	}
+}
+
+func TestRejectedAcks(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity: 2,
+		CanAck:   func(setFlag, ackFlag int) bool { return false },
+	})
+	a.Set(1, 0, "v")
+	for i := 1; i <= 3; i++ {
+		a.Ack(1, 0)
+		if n := a.Stats().RejectedAcks; n != int64(i) {
+			t.Fatalf("RejectedAcks = %d after %d rejected acks", n, i)
+		}
+	}
+	// acks of absent ids are not rejections.
+	a.Ack(2, 0)
+	if n := a.Stats().RejectedAcks; n != 3 {
+		t.Fatalf("RejectedAcks = %d after an ack of an absent id, want 3", n)
+	}
+}
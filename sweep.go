@@ -0,0 +1,217 @@
+package ack
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sweeper sweeps pending messages every sweepInterval until stopCh is closed, then it closes
+// timeoutCh if it is not nil.
+func (a *AckManager[flag, val]) sweeper(stopCh chan struct{}, timeoutCh chan *Msg[flag, val]) {
+	defer atomic.AddInt32(&a.goroutines, -1)
+	t := time.NewTicker(a.sweepInterval)
+	defer t.Stop()
+	if timeoutCh != nil {
+		defer close(timeoutCh)
+	}
+	for {
+		select {
+		case <-t.C:
+			a.sweep(int64(a.timeout), stopCh, timeoutCh)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// SweepOnce runs a single sweep in the calling goroutine, like the sweeper does every
+// SweepInterval: messages not acked after duration are resent by Resend, and the ones resent
+// MaxRetries times or older than MaxAge are dead-lettered. It lets callers run their own ticker,
+// and tests sweep deterministically with a fake clock. SweepInterval doesn't need to be set, and
+// the Timeouts channel is not fed.
+func (a *AckManager[flag, val]) SweepOnce(duration int64) {
+	a.sweep(duration, nil, nil)
+}
+
+// Timeouts returns the channel the sweeper sends resent messages to, if TimeoutsBufferSize is set.
+// The channel is closed when the ack manager is stopped, and Start makes a new one, so Timeouts
+// should be called after Start. Consumers may range over it and ack the messages they handle.
+func (a *AckManager[flag, val]) Timeouts() <-chan *Msg[flag, val] {
+	return a.timeoutCh
+}
+
+// sweep resends messages not acked after duration, and dead-letters the ones already resent
+// maxRetries times or older than maxAge, in a single pass. Resent messages are also sent to
+// timeoutCh if it is not nil. Callbacks are called after the segment lock is released.
+func (a *AckManager[flag, val]) sweep(duration int64, stopCh chan struct{}, timeoutCh chan *Msg[flag, val]) {
+	for _, r := range a.records {
+		resend, dead := r.Sweep(duration)
+		for _, m := range dead {
+			a.logger.Warn("msg dead-lettered", "id", m.ID, "retries", m.Retries)
+			if a.onDeadLetter != nil {
+				a.onDeadLetter(m)
+			}
+			a.removed(RemoveDeadLettered, m)
+		}
+		atomic.AddInt64(&a.retries, int64(len(resend)))
+		if a.resend != nil {
+			a.resendAll(resend)
+		}
+		if timeoutCh != nil {
+			for _, m := range resend {
+				if !a.timedOut(m, stopCh, timeoutCh) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// resendAll calls resend for msgs, callbackConcurrency of them at a time, and waits for all of
+// them to return.
+func (a *AckManager[flag, val]) resendAll(msgs []*Msg[flag, val]) {
+	resend := func(m *Msg[flag, val]) {
+		if err := a.resend(m); err != nil {
+			a.setLastError(err)
+			a.logger.Warn("resend msg failed", "id", m.ID, "err", err)
+		}
+	}
+	if a.callbackConcurrency <= 1 || len(msgs) <= 1 {
+		for _, m := range msgs {
+			resend(m)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, a.callbackConcurrency)
+	for _, m := range msgs {
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			resend(m)
+		})
+	}
+	wg.Wait()
+}
+
+// timedOut sends m to timeoutCh according to timeoutsOverflow. It returns false if stopCh is
+// closed while waiting for room.
+func (a *AckManager[flag, val]) timedOut(m *Msg[flag, val], stopCh chan struct{}, timeoutCh chan *Msg[flag, val]) bool {
+	if a.timeoutsOverflow == OverflowBlock {
+		select {
+		case timeoutCh <- m:
+			return true
+		case <-stopCh:
+			return false
+		}
+	}
+	select {
+	case timeoutCh <- m:
+	default:
+		a.logger.Warn("timeouts channel is full, msg dropped", "id", m.ID)
+	}
+	return true
+}
+
+// Sweep refreshes timestamps of messages not acked after duration, or the timeout timeoutFor
+// gives for their flag, and counts them as retried, or removes them if they have been retried
+// maxRetries times. Messages are not retried again before their NotBefore. Messages older than
+// maxAge are removed regardless of retries. It returns the retried messages and the removed ones.
+func (r *recorder[flag, val]) Sweep(duration int64) (retried, removed []*Msg[flag, val]) {
+	now := r.am.now()
+	r.lock()
+	if r.am.fifo {
+		retried, removed = r.sweepFIFO(duration, now)
+	} else {
+		for id, m := range r.msgs {
+			switch r.sweepAction(m, duration, now) {
+			case sweepRemove:
+				r.delete(id)
+				removed = append(removed, m)
+			case sweepRetry:
+				retried = append(retried, r.retry(m, now))
+			}
+		}
+	}
+	empty := len(removed) > 0 && r.am.release(len(removed))
+	r.Unlock()
+	if empty {
+		r.am.notifyEmpty()
+	}
+	return retried, removed
+}
+
+// sweepFIFO is Sweep in FIFO mode. It scans the FIFO queue from the front and stops at the first
+// message not expired, moving the resent and the leased messages to the back.
+func (r *recorder[flag, val]) sweepFIFO(duration, now int64) (retried, removed []*Msg[flag, val]) {
+	var back []*Msg[flag, val]
+	i := 0
+scan:
+	for ; i < len(r.fifo); i++ {
+		m, ok := r.live(r.fifo[i])
+		if !ok {
+			continue
+		}
+		switch r.sweepAction(m, duration, now) {
+		case sweepWait:
+			break scan
+		case sweepLeased:
+			back = append(back, m)
+		case sweepRemove:
+			r.delete(m.ID)
+			removed = append(removed, m)
+		case sweepRetry:
+			c := r.retry(m, now)
+			retried = append(retried, c)
+			back = append(back, c)
+		}
+	}
+	r.fifo = append(r.fifo[i:], back...)
+	return retried, removed
+}
+
+// sweep actions decided by sweepAction.
+const (
+	sweepWait   = iota // not expired yet
+	sweepLeased        // expired but leased until NotBefore
+	sweepRemove        // dead-lettered
+	sweepRetry         // resent
+)
+
+// sweepAction decides what Sweep does with m.
+func (r *recorder[flag, val]) sweepAction(m *Msg[flag, val], duration, now int64) int {
+	if maxAge := int64(r.am.maxAge); maxAge > 0 && now-m.Created >= maxAge {
+		return sweepRemove
+	}
+	timeout := duration
+	if r.am.timeoutFor != nil {
+		if t := r.am.timeoutFor(m.Flag); t > 0 {
+			timeout = int64(t)
+		}
+	}
+	switch {
+	case now-m.Timestamp < timeout:
+		return sweepWait
+	case now < m.NotBefore:
+		return sweepLeased
+	case r.am.maxRetries > 0 && m.Retries >= r.am.maxRetries:
+		return sweepRemove
+	}
+	return sweepRetry
+}
+
+// retry replaces m by a copy counted as resent at now, and returns the copy. It must be called
+// with the write lock held.
+func (r *recorder[flag, val]) retry(m *Msg[flag, val], now int64) *Msg[flag, val] {
+	c := *m
+	c.Retries++
+	c.Timestamp = now
+	if r.am.backoff != nil {
+		c.NotBefore = now + int64(r.am.backoff(c.Retries))
+	}
+	r.changed(&c)
+	r.msgs[m.ID] = &c
+	return &c
+}
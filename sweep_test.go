@@ -0,0 +1,197 @@
+package ack
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSweeperRetriesThenDeadLetters(t *testing.T) {
+	var mu sync.Mutex
+	var resent []int
+	var dead *Msg[int, string]
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:      2,
+		SweepInterval: time.Millisecond,
+		Timeout:       time.Millisecond,
+		MaxRetries:    2,
+		Resend: func(m *Msg[int, string]) error {
+			mu.Lock()
+			resent = append(resent, m.Retries)
+			mu.Unlock()
+			return nil
+		},
+		OnDeadLetter: func(m *Msg[int, string]) {
+			mu.Lock()
+			dead = m
+			mu.Unlock()
+		},
+	})
+	a.Set(1, 0, "v")
+	a.Set(2, 0, "v")
+	a.Ack(2, 0)
+	a.Start()
+	defer a.Stop()
+	waitFor(t, "message dead-lettered", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return dead != nil
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if dead.ID != 1 || dead.Retries != 2 {
+		t.Fatalf("dead-lettered message %d after %d retries, want message 1 after 2", dead.ID, dead.Retries)
+	}
+	if len(resent) != 2 || resent[0] != 1 || resent[1] != 2 {
+		t.Fatalf("resent with retries %v, want [1 2]", resent)
+	}
+	if a.Len() != 0 || a.Stats().Retries != 2 {
+		t.Fatalf("Len = %d with %d retries, want 0 with 2", a.Len(), a.Stats().Retries)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	clock := newFakeClock()
+	var dead []int64
+	var reasons []RemoveReason
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:     2,
+		Now:          clock.Now,
+		MaxAge:       time.Minute,
+		OnDeadLetter: func(m *Msg[int, string]) { dead = append(dead, m.ID) },
+		OnRemove:     func(m *Msg[int, string], reason RemoveReason) { reasons = append(reasons, reason) },
+	})
+	a.Set(1, 0, "v")
+	clock.Add(30 * time.Second)
+	a.Set(2, 0, "v")
+	// resends refresh Timestamp but not the age.
+	for range 3 {
+		clock.Add(10 * time.Second)
+		a.SweepOnce(int64(time.Second))
+	}
+	if len(dead) != 1 || dead[0] != 1 {
+		t.Fatalf("dead-lettered %v past MaxAge, want message 1", dead)
+	}
+	if len(reasons) != 1 || reasons[0] != RemoveDeadLettered {
+		t.Fatalf("OnRemove got %v, want %v", reasons, RemoveDeadLettered)
+	}
+	if _, ok := a.GetByID(2); !ok {
+		t.Fatal("message 2 removed before MaxAge")
+	}
+}
+
+func TestTimeoutFor(t *testing.T) {
+	clock := newFakeClock()
+	tiers := []time.Duration{time.Second, 5 * time.Second, 30 * time.Second, 0}
+	var resent []int64
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:   2,
+		Now:        clock.Now,
+		TimeoutFor: func(f int) time.Duration { return tiers[f] },
+		Resend: func(m *Msg[int, string]) error {
+			resent = append(resent, m.ID)
+			return nil
+		},
+	})
+	for f := range tiers {
+		a.Set(int64(f), f, "v")
+	}
+	sweepAt := func(d time.Duration, want ...int64) {
+		t.Helper()
+		clock.Add(d)
+		resent = nil
+		// 10s is the timeout of tier 3 falling back to it.
+		a.SweepOnce(int64(10 * time.Second))
+		slices.Sort(resent)
+		if !slices.Equal(resent, want) {
+			t.Fatalf("resent %v, want %v", resent, want)
+		}
+	}
+	sweepAt(time.Second, 0)
+	sweepAt(4*time.Second, 0, 1)
+	sweepAt(5*time.Second, 0, 1, 3)
+	sweepAt(20*time.Second, 0, 1, 2, 3)
+}
+
+func TestResetRetriesOnSet(t *testing.T) {
+	for _, reset := range []bool{false, true} {
+		clock := newFakeClock()
+		a, _ := NewAckManager(&Config[int, string]{Capacity: 2, Now: clock.Now, ResetRetriesOnSet: reset})
+		a.Set(1, 0, "v")
+		for range 2 {
+			clock.Add(time.Second)
+			a.SweepOnce(1)
+		}
+		a.Set(1, 0, "w")
+		want := 2
+		if reset {
+			want = 0
+		}
+		if m, _ := a.GetByID(1); m.Retries != want || m.Value != "w" {
+			t.Fatalf("ResetRetriesOnSet %v: message %+v set again, want %d retries", reset, *m, want)
+		}
+	}
+}
+
+func TestSweepOnce(t *testing.T) {
+	clock := newFakeClock()
+	var resent, dead []int64
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:           2,
+		Now:                clock.Now,
+		MaxRetries:         1,
+		TimeoutsBufferSize: 4,
+		Resend: func(m *Msg[int, string]) error {
+			resent = append(resent, m.ID)
+			return nil
+		},
+		OnDeadLetter: func(m *Msg[int, string]) { dead = append(dead, m.ID) },
+	})
+	a.Set(1, 0, "v")
+	clock.Add(time.Second)
+	a.Set(2, 0, "v")
+	timeout := int64(time.Second)
+	a.SweepOnce(timeout)
+	if !slices.Equal(resent, []int64{1}) || len(dead) != 0 {
+		t.Fatalf("first sweep resent %v and dead-lettered %v, want message 1 resent", resent, dead)
+	}
+	clock.Add(time.Second)
+	a.SweepOnce(timeout)
+	if !slices.Equal(resent, []int64{1, 2}) || !slices.Equal(dead, []int64{1}) {
+		t.Fatalf("second sweep resent %v and dead-lettered %v, want 2 resent and 1 dead-lettered", resent, dead)
+	}
+	if a.GoroutineCount() != 0 || a.Timeouts() != nil {
+		t.Fatal("SweepOnce started the sweeper")
+	}
+}
+
+func TestCallbackConcurrency(t *testing.T) {
+	clock := newFakeClock()
+	var running, peak atomic.Int32
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:            1,
+		Now:                 clock.Now,
+		CallbackConcurrency: 3,
+		Resend: func(m *Msg[int, string]) error {
+			n := running.Add(1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+			return nil
+		},
+	})
+	for id := range int64(20) {
+		a.Set(id, 0, "v")
+	}
+	clock.Add(time.Second)
+	a.SweepOnce(1)
+	if p := peak.Load(); p != 3 {
+		t.Fatalf("%d Resend calls ran at once, want CallbackConcurrency", p)
+	}
+	if running.Load() != 0 {
+		t.Fatal("SweepOnce returned before the Resend calls")
+	}
+}
@@ -0,0 +1,41 @@
+package ack
+
+import "sync/atomic"
+
+// threshold is a pair of pending thresholds registered by OnPendingThreshold.
+type threshold struct {
+	high, low     int64
+	onHigh, onLow func()
+	above         int32 // 1 after onHigh until onLow
+}
+
+// OnPendingThreshold calls onHigh when pending messages rise above high, and onLow when they drop
+// below low afterwards, e.g. to scale consumers or shed load. low should be less than high, so
+// that the callbacks don't flap around a single threshold. The callbacks are called under a
+// segment lock by the Set or the removal crossing the threshold, so they must be quick and must
+// not call back into the ack manager. Registering again replaces the previous thresholds.
+func (a *AckManager[flag, val]) OnPendingThreshold(high, low int, onHigh, onLow func()) {
+	a.threshold.Store(&threshold{high: int64(high), low: int64(low), onHigh: onHigh, onLow: onLow})
+}
+
+// added counts a pending message as added, unless reserved tells waitRoom already counted it.
+func (a *AckManager[flag, val]) added(reserved bool) {
+	var pending int64
+	if reserved {
+		pending = atomic.LoadInt64(&a.pending)
+	} else {
+		pending = atomic.AddInt64(&a.pending, 1)
+	}
+	if t := a.threshold.Load(); t != nil && pending > t.high && atomic.CompareAndSwapInt32(&t.above, 0, 1) &&
+		t.onHigh != nil {
+		t.onHigh()
+	}
+}
+
+// crossedLow calls onLow if pending messages drop below the low threshold.
+func (a *AckManager[flag, val]) crossedLow(pending int64) {
+	if t := a.threshold.Load(); t != nil && pending < t.low && atomic.CompareAndSwapInt32(&t.above, 1, 0) &&
+		t.onLow != nil {
+		t.onLow()
+	}
+}
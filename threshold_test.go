@@ -0,0 +1,47 @@
+package ack
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestOnPendingThreshold(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{Capacity: 2})
+	var events []string
+	a.OnPendingThreshold(4, 2, func() { events = append(events, "high") }, func() { events = append(events, "low") })
+	step := func(what string, fn func(), want ...string) {
+		t.Helper()
+		events = nil
+		fn()
+		if !slices.Equal(events, want) {
+			t.Fatalf("%s: callbacks %v, want %v", what, events, want)
+		}
+	}
+	step("up to high", func() {
+		for id := range int64(4) {
+			a.Set(id, 0, "v")
+		}
+	})
+	step("above high", func() { a.Set(4, 0, "v") }, "high")
+	step("further above high", func() { a.Set(5, 0, "v") })
+	// between the thresholds nothing flaps.
+	step("down between", func() {
+		a.Ack(5, 0)
+		a.Ack(4, 0)
+		a.Ack(3, 0)
+	})
+	step("up between", func() {
+		a.Set(3, 0, "v")
+		a.Set(4, 0, "v")
+	})
+	step("below low", func() {
+		for id := range int64(5) {
+			a.Ack(id, 0)
+		}
+	}, "low")
+	step("above high again", func() {
+		for id := range int64(5) {
+			a.Set(id, 0, "v")
+		}
+	}, "high")
+}
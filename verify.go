@@ -0,0 +1,57 @@
+package ack
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Verify checks the invariants of the ack manager, and returns an error describing the first
+// violation found: the pending and bytes counters must match the messages recorded, and every
+// message must be recorded under its id in the segment its id maps to. It locks all segments
+// during the check, so it is meant for diagnosis rather than for hot paths.
+func (a *AckManager[flag, val]) Verify() error {
+	for _, r := range a.records {
+		r.lock()
+	}
+	defer func() {
+		for _, r := range a.records {
+			r.Unlock()
+		}
+	}()
+
+	var pending, bytes int64
+	for i, r := range a.records {
+		for id, m := range r.msgs {
+			if m == nil {
+				return fmt.Errorf("nil msg of id %d in segment %d", id, i)
+			}
+			if m.ID != id {
+				return fmt.Errorf("msg of id %d recorded as id %d in segment %d", m.ID, id, i)
+			}
+			if j := a.index(id); j != i {
+				return fmt.Errorf("msg of id %d recorded in segment %d instead of %d", id, i, j)
+			}
+			pending++
+			bytes += m.size
+		}
+		for id, queued := range r.queued {
+			if _, ok := r.msgs[id]; !ok {
+				return fmt.Errorf("msgs of id %d queued in segment %d without a recorded one", id, i)
+			}
+			for _, m := range queued {
+				if m == nil || m.ID != id {
+					return fmt.Errorf("bad msg queued as id %d in segment %d", id, i)
+				}
+				pending++
+				bytes += m.size
+			}
+		}
+	}
+	if n := atomic.LoadInt64(&a.pending); n != pending {
+		return fmt.Errorf("pending counter is %d but %d msgs are recorded", n, pending)
+	}
+	if n := atomic.LoadInt64(&a.bytes); n != bytes {
+		return fmt.Errorf("bytes counter is %d but recorded msgs have %d bytes", n, bytes)
+	}
+	return nil
+}
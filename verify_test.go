@@ -0,0 +1,38 @@
+package ack
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestVerifyDetectsCorruption(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		corrupt func(a *AckManager[int, string])
+	}{
+		{"pending counter", func(a *AckManager[int, string]) { atomic.AddInt64(&a.pending, 1) }},
+		{"bytes counter", func(a *AckManager[int, string]) { atomic.AddInt64(&a.bytes, -1) }},
+		{"nil msg", func(a *AckManager[int, string]) { a.records[0].msgs[8] = nil }},
+		{"wrong id", func(a *AckManager[int, string]) { a.records[0].msgs[0].ID = 4 }},
+		{"wrong segment", func(a *AckManager[int, string]) {
+			m := a.records[0].msgs[0]
+			delete(a.records[0].msgs, 0)
+			a.records[1].msgs[0] = m
+		}},
+		{"queued without a recorded msg", func(a *AckManager[int, string]) {
+			a.records[0].queued = map[int64][]*Msg[int, string]{12: {newMsg(12, 0, "v", 0)}}
+		}},
+	} {
+		a, _ := NewAckManager(&Config[int, string]{Capacity: 2, SizeOf: func(v string) int { return len(v) }})
+		for id := int64(0); id < 4; id++ {
+			a.Set(id, 0, "v")
+		}
+		if err := a.Verify(); err != nil {
+			t.Fatalf("%s: Verify before corruption = %v", tt.name, err)
+		}
+		tt.corrupt(a)
+		if err := a.Verify(); err == nil {
+			t.Errorf("%s: Verify = nil after corruption", tt.name)
+		}
+	}
+}
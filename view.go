@@ -0,0 +1,35 @@
+package ack
+
+import "time"
+
+// ManagerView is a read-only view of an ack manager. It lets inspection code, like a debug
+// handler, look into pending messages while ensuring at compile time that it can't set or ack.
+type ManagerView[flag, val any] struct {
+	am *AckManager[flag, val]
+}
+
+// View returns a read-only view of the ack manager.
+func (a *AckManager[flag, val]) View() ManagerView[flag, val] {
+	return ManagerView[flag, val]{am: a}
+}
+
+// Len returns the number of pending messages.
+func (v ManagerView[flag, val]) Len() int {
+	return v.am.Len()
+}
+
+// OldestAge returns how long the oldest pending message has been waiting for ack.
+func (v ManagerView[flag, val]) OldestAge() time.Duration {
+	return v.am.OldestAge()
+}
+
+// ForEach calls fn for each pending message until fn returns false. fn must not modify the
+// message.
+func (v ManagerView[flag, val]) ForEach(fn func(*Msg[flag, val]) bool) {
+	v.am.ForEach(fn)
+}
+
+// Stats returns current counters of the ack manager.
+func (v ManagerView[flag, val]) Stats() Stats {
+	return v.am.Stats()
+}
@@ -0,0 +1,80 @@
+package ack
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// worker holds async buffers processed by a daemon goroutine. All segments share a single worker
+// by default, each segment has its own one with PerSegmentChannels, or they are spread over
+// Workers workers.
+type worker[flag, val any] struct {
+	setCh  chan *Msg[flag, val]
+	ackCh  chan *Msg[flag, val]
+	doneCh chan struct{} // closed when the daemon goroutine exits
+}
+
+func newWorker[flag, val any](setBufferSize, ackBufferSize int64) *worker[flag, val] {
+	return &worker[flag, val]{
+		setCh: make(chan *Msg[flag, val], setBufferSize),
+		ackCh: make(chan *Msg[flag, val], ackBufferSize),
+	}
+}
+
+// worker returns the worker processing the message id.
+func (a *AckManager[flag, val]) worker(id int64) *worker[flag, val] {
+	if len(a.workers) == 1 {
+		return a.workers[0]
+	}
+	return a.workers[a.index(id)%len(a.workers)]
+}
+
+// ackCh returns the buffer of acks of the message id.
+func (a *AckManager[flag, val]) ackCh(id int64) chan *Msg[flag, val] {
+	if a.orderedSetAck {
+		return a.worker(id).setCh
+	}
+	return a.worker(id).ackCh
+}
+
+// takeAll appends all messages buffered in ch to dst without processing them.
+func takeAll[flag, val any](ch chan *Msg[flag, val], dst []*Msg[flag, val]) []*Msg[flag, val] {
+	for len(ch) > 0 {
+		select {
+		case m := <-ch:
+			dst = append(dst, m)
+		default:
+		}
+	}
+	return dst
+}
+
+// ResizeBuffers changes the sizes of the async buffers, moving the messages buffered to the new
+// buffers. It fails with ErrRunning if the daemon goroutine is running, and with an error if a
+// buffer holds more messages than its new size. Like Resize, it must not be called concurrently
+// with other methods.
+func (a *AckManager[flag, val]) ResizeBuffers(setSize, ackSize int64) error {
+	if !a.async {
+		return nil
+	}
+	if atomic.LoadInt32(&a.status) != stopped {
+		return ErrRunning
+	}
+	for _, w := range a.workers {
+		if int64(len(w.setCh)) > setSize || int64(len(w.ackCh)) > ackSize {
+			return errors.New("buffered messages don't fit in the new buffer sizes")
+		}
+	}
+	for _, w := range a.workers {
+		setCh, ackCh := w.setCh, w.ackCh
+		w.setCh = make(chan *Msg[flag, val], setSize)
+		w.ackCh = make(chan *Msg[flag, val], ackSize)
+		for _, m := range takeAll(setCh, nil) {
+			w.setCh <- m
+		}
+		for _, m := range takeAll(ackCh, nil) {
+			w.ackCh <- m
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package ack
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPerSegmentChannels(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:           4,
+		Async:              true,
+		PerSegmentChannels: true,
+		SetBufferSize:      8,
+		AckBufferSize:      8,
+	})
+	a.Start()
+	if n := a.GoroutineCount(); n != 4 {
+		t.Fatalf("GoroutineCount = %d, want a daemon per segment", n)
+	}
+	for id := int64(0); id < 20; id++ {
+		a.Set(id, 0, "v")
+	}
+	waitFor(t, "messages recorded", func() bool { return a.Len() == 20 })
+	for id := int64(0); id < 20; id += 2 {
+		a.Ack(id, 0)
+	}
+	if _, err := a.StopAndDrain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if a.Len() != 10 {
+		t.Fatalf("Len = %d, want 10", a.Len())
+	}
+}
+
+// BenchmarkAsyncChannels sets and acks messages from many goroutines in async mode, through the
+// shared buffers or through buffers per segment.
+func BenchmarkAsyncChannels(b *testing.B) {
+	for _, bb := range []struct {
+		name       string
+		perSegment bool
+	}{{"shared", false}, {"per-segment", true}} {
+		b.Run(bb.name, func(b *testing.B) {
+			a, _ := NewAckManager(&Config[int64, int64]{
+				Capacity:           16,
+				Async:              true,
+				PerSegmentChannels: bb.perSegment,
+				SetBufferSize:      1024,
+				AckBufferSize:      1024,
+			})
+			a.Start()
+			var next atomic.Int64
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				id := next.Add(1 << 32)
+				for i := int64(0); pb.Next(); i++ {
+					a.Set(id+i, 0, 0)
+					a.Ack(id+i, 0)
+				}
+			})
+			a.StopAndDrain(context.Background())
+		})
+	}
+}
+
+func TestWorkersUneven(t *testing.T) {
+	for _, tt := range []struct{ capacity, workers int }{{5, 2}, {3, 7}, {8, 3}} {
+		a, _ := NewAckManager(&Config[int, string]{
+			Capacity:      tt.capacity,
+			Async:         true,
+			Workers:       tt.workers,
+			SetBufferSize: 64,
+			AckBufferSize: 64,
+		})
+		served := make(map[*worker[int, string]]int)
+		for id := int64(0); id < int64(tt.capacity); id++ {
+			w := a.worker(id)
+			if want := a.workers[a.index(id)%len(a.workers)]; w != want {
+				t.Fatalf("%d segments, %d workers: segment %d not served by worker %d", tt.capacity, tt.workers,
+					id, a.index(id)%len(a.workers))
+			}
+			served[w]++
+		}
+		if n := min(tt.capacity, tt.workers); len(a.workers) != n || len(served) != n {
+			t.Fatalf("%d segments, %d workers: %d workers serving %d, want %d", tt.capacity, tt.workers,
+				len(a.workers), len(served), n)
+		}
+		a.Start()
+		for id := int64(0); id < 40; id++ {
+			a.Set(id, 0, "v")
+		}
+		waitFor(t, "messages recorded", func() bool { return a.Len() == 40 })
+		a.Stop()
+	}
+}
+
+func TestResizeBuffers(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:       2,
+		Async:          true,
+		SetBufferSize:  2,
+		AckBufferSize:  2,
+		OverflowPolicy: OverflowError,
+	})
+	a.Set(1, 0, "v")
+	a.Set(2, 0, "v")
+	a.Ack(1, 0)
+	if err := a.ResizeBuffers(1, 1); err == nil {
+		t.Fatal("ResizeBuffers to sizes smaller than the buffered messages succeeded")
+	}
+	if err := a.ResizeBuffers(4, 4); err != nil {
+		t.Fatal(err)
+	}
+	w := a.workers[0]
+	if cap(w.setCh) != 4 || cap(w.ackCh) != 4 || len(w.setCh) != 2 || len(w.ackCh) != 1 {
+		t.Fatalf("buffers of %d/%d sets and %d/%d acks, want the buffered messages migrated",
+			len(w.setCh), cap(w.setCh), len(w.ackCh), cap(w.ackCh))
+	}
+	if err := a.Set(3, 0, "v"); err != nil {
+		t.Fatalf("Set into the grown buffer = %v", err)
+	}
+	a.Start()
+	if err := a.ResizeBuffers(8, 8); err != ErrRunning {
+		t.Fatalf("ResizeBuffers while running = %v, want %v", err, ErrRunning)
+	}
+	if _, err := a.StopAndDrain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := a.Stats(); s.ProcessedSets != 3 || s.ProcessedAcks != 1 {
+		t.Fatalf("processed %d sets and %d acks, want the migrated messages processed", s.ProcessedSets,
+			s.ProcessedAcks)
+	}
+}
+
+func TestOrderedSetAckStress(t *testing.T) {
+	a, _ := NewAckManager(&Config[int, string]{
+		Capacity:      4,
+		Async:         true,
+		Workers:       2,
+		OrderedSetAck: true,
+		SetBufferSize: 16,
+	})
+	a.Start()
+	var wg sync.WaitGroup
+	for g := range int64(8) {
+		wg.Go(func() {
+			// each goroutine sets and acks its own ids over and over, every ack right after its set.
+			for i := range int64(2000) {
+				id := g*10 + i%10
+				a.Set(id, 0, "v")
+				a.Ack(id, 0)
+			}
+		})
+	}
+	wg.Wait()
+	if _, err := a.StopAndDrain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := a.Len(); n != 0 {
+		t.Fatalf("%d messages left pending by acks processed before their sets", n)
+	}
+}